@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// certSourceSelfSigned generates and rotates a self-signed CA and TLS cert in the secret
+	certSourceSelfSigned = "self-signed"
+	// certSourceCertManager has cert-manager issue the TLS cert into the secret from a Certificate
+	certSourceCertManager = "cert-manager"
+
+	// injectCAAnnotation tells the cert-manager CA injector which Certificate's CA to put in the caBundle
+	injectCAAnnotation = "cert-manager.io/inject-ca-from"
+)
+
+var certificateResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+// certManagerOptions configure the Certificate used when the cert source is cert-manager
+type certManagerOptions struct {
+	certificateName string
+	issuerName      string
+	issuerKind      string
+	issuerGroup     string
+	injectCA        bool
+}
+
+// injectsCA checks if the cert-manager CA injector manages the webhook's caBundle
+func (m Manager) injectsCA() bool {
+	return m.certSource == certSourceCertManager && m.certManager.injectCA
+}
+
+// desiredCertificateSpec returns the spec of the Certificate for the service's dns names
+func (m Manager) desiredCertificateSpec() map[string]interface{} {
+	dnsNames := []interface{}{}
+	for _, dnsName := range m.dnsNames {
+		dnsNames = append(dnsNames, dnsName)
+	}
+	return map[string]interface{}{
+		"secretName":  m.secretName,
+		"commonName":  m.dnsNames[0],
+		"dnsNames":    dnsNames,
+		"usages":      []interface{}{"digital signature", "key encipherment", "server auth"},
+		"duration":    m.certs.validity.String(),
+		"renewBefore": m.certs.renewBefore.String(),
+		"privateKey": map[string]interface{}{
+			"algorithm": strings.ToUpper(m.certs.keyAlgorithm),
+			"size":      int64(m.certs.keySize),
+		},
+		"issuerRef": map[string]interface{}{
+			"name":  m.certManager.issuerName,
+			"kind":  m.certManager.issuerKind,
+			"group": m.certManager.issuerGroup,
+		},
+	}
+}
+
+// createOrUpdateCertificate makes sure cert-manager issues the certs into the secret
+func (m Manager) createOrUpdateCertificate() error {
+	certificateClient := m.dynamicClient.Resource(certificateResource).Namespace(m.namespace)
+	spec := m.desiredCertificateSpec()
+
+	return retry.OnError(retryBackoff, retriable, func() error {
+		certificate, err := certificateClient.Get(m.ctx, m.certManager.certificateName, metav1.GetOptions{})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return err
+			}
+
+			certificate = &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "cert-manager.io/v1",
+				"kind":       "Certificate",
+				"metadata": map[string]interface{}{
+					"name":      m.certManager.certificateName,
+					"namespace": m.namespace,
+				},
+				"spec": spec,
+			}}
+			_, err = certificateClient.Create(m.ctx, certificate, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			logger.Info("Created certificate", "certificate", m.certManager.certificateName)
+			m.recorder.Eventf(m.deploymentRef(), corev1.EventTypeNormal, "CertificateCreated", "Created certificate/%s", m.certManager.certificateName)
+			return nil
+		}
+
+		current, _, err := unstructured.NestedMap(certificate.Object, "spec")
+		if err != nil {
+			return err
+		}
+		if equality.Semantic.DeepDerivative(spec, current) {
+			return nil
+		}
+		// Only the fields the manager owns are replaced, others like subject are kept
+		for key, value := range spec {
+			current[key] = value
+		}
+		if err := unstructured.SetNestedMap(certificate.Object, current, "spec"); err != nil {
+			return err
+		}
+		_, err = certificateClient.Update(m.ctx, certificate, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		logger.Info("Updated certificate", "certificate", m.certManager.certificateName)
+		m.recorder.Eventf(m.deploymentRef(), corev1.EventTypeNormal, "CertificateUpdated", "Updated certificate/%s", m.certManager.certificateName)
+		return nil
+	})
+}
+
+// injectCAFrom returns the value of the CA injector annotation
+func (m Manager) injectCAFrom() string {
+	return fmt.Sprintf("%s/%s", m.namespace, m.certManager.certificateName)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/isaaguilar/selfsigned"
+)
+
+const (
+	keyAlgorithmRSA   = "rsa"
+	keyAlgorithmECDSA = "ecdsa"
+)
+
+// certOptions configure how self-signed certs are generated and when certs are renewed
+type certOptions struct {
+	// validity is how long a new tls cert is valid for
+	validity time.Duration
+	// caValidity is how long a new ca cert is valid for
+	caValidity time.Duration
+	// renewBefore is the window before expiry when certs are renewed
+	renewBefore time.Duration
+	// recheckInterval is the longest time between cert checks
+	recheckInterval time.Duration
+	// caRolloverGracePeriod is how long the old and new ca are both trusted during a ca rollover
+	caRolloverGracePeriod time.Duration
+	keyAlgorithm          string
+	// keySize is the RSA key size in bits or the ECDSA curve size
+	keySize int
+}
+
+func (o certOptions) validate() error {
+	switch o.keyAlgorithm {
+	case keyAlgorithmRSA:
+		if o.keySize < 2048 {
+			return fmt.Errorf("rsa key size must be at least 2048")
+		}
+	case keyAlgorithmECDSA:
+		if _, err := o.curve(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown key algorithm '%s'", o.keyAlgorithm)
+	}
+	if o.renewBefore >= o.validity {
+		return fmt.Errorf("cert renewal window %s must be shorter than the cert validity %s", o.renewBefore, o.validity)
+	}
+	if o.validity > o.caValidity {
+		return fmt.Errorf("cert validity %s must not be longer than the ca validity %s", o.validity, o.caValidity)
+	}
+	if o.renewBefore+2*o.caRolloverGracePeriod >= o.caValidity {
+		return fmt.Errorf("ca validity %s must be longer than the renewal window plus twice the ca rollover grace period", o.caValidity)
+	}
+	if o.recheckInterval <= 0 {
+		return fmt.Errorf("cert recheck interval must be positive")
+	}
+	return nil
+}
+
+func (o certOptions) curve() (elliptic.Curve, error) {
+	switch o.keySize {
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("ecdsa key size must be 256, 384 or 521")
+}
+
+func (o certOptions) newPrivateKey() (crypto.Signer, error) {
+	if o.keyAlgorithm == keyAlgorithmECDSA {
+		curve, err := o.curve()
+		if err != nil {
+			return nil, err
+		}
+		return ecdsa.GenerateKey(curve, cryptorand.Reader)
+	}
+	return rsa.GenerateKey(cryptorand.Reader, o.keySize)
+}
+
+// nextCheck returns how long until the cert enters its renewal window, but no longer than the recheck
+// interval
+func (o certOptions) nextCheck(tlsCertData []byte) time.Duration {
+	cert, err := x509Cert(tlsCertData)
+	if err != nil {
+		return o.recheckInterval
+	}
+	until := time.Until(cert.NotAfter.Add(-o.renewBefore))
+	if until < 10*time.Second {
+		return 10 * time.Second
+	}
+	if until > o.recheckInterval {
+		return o.recheckInterval
+	}
+	return until
+}
+
+// parsePrivateKey parses a PEM encoded PKCS1, PKCS8 or EC private key
+func parsePrivateKey(keyData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse key PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: " + err.Error())
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// signingCert returns the cert in the ca bundle that belongs to the ca key. The bundle holds more than
+// one ca cert during a ca rollover.
+func signingCert(caCertData []byte, caKey crypto.Signer) (*x509.Certificate, error) {
+	publicKey, ok := caKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", caKey)
+	}
+	for rest := caCertData; len(rest) > 0; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if publicKey.Equal(cert.PublicKey) {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("no ca cert matches the ca key")
+}
+
+func serialNumber() (*big.Int, error) {
+	return cryptorand.Int(cryptorand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+}
+
+// newCA generates a self-signed ca cert and key
+func (o certOptions) newCA() (*selfsigned.Signer, error) {
+	key, err := o.newPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA private key: %s", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "selfsigned"},
+		NotBefore:             now.UTC(),
+		NotAfter:              now.Add(o.caValidity).UTC(),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, &tmpl, &tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA cert: %s", err)
+	}
+	keyPEM, err := selfsigned.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &selfsigned.Signer{
+		CAKey:  keyPEM,
+		CACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+// newTLS generates a tls cert and key for the dns names signed by the ca. The cert never outlives the ca.
+func (o certOptions) newTLS(signer selfsigned.Signer, dnsNames []string) (tlsCert, tlsKey []byte, err error) {
+	caKey, err := parsePrivateKey(signer.CAKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := signingCert(signer.CACert, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := o.newPrivateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create private key: %s", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	notAfter := time.Now().Add(o.validity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+	tmpl := x509.Certificate{
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		SerialNumber: serial,
+		NotBefore:    caCert.NotBefore,
+		NotAfter:     notAfter.UTC(),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, &tmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cert: %s", err)
+	}
+	tlsKey, err = selfsigned.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), tlsKey, nil
+}
+
+// newSelfSignedCert generates a new ca and a tls cert signed by it
+func (o certOptions) newSelfSignedCert(dnsNames []string) (*selfsigned.SelfSignedCert, error) {
+	signer, err := o.newCA()
+	if err != nil {
+		return nil, err
+	}
+	tlsCert, tlsKey, err := o.newTLS(*signer, dnsNames)
+	if err != nil {
+		return nil, err
+	}
+	return &selfsigned.SelfSignedCert{Signer: *signer, TLSCert: tlsCert, TLSKey: tlsKey}, nil
+}
+
+// renew issues a new tls cert from the same ca. The ca is replaced as well when it is unusable or within
+// the renewal window since a tls cert signed by it could not outlive it. The latter only happens when
+// the ca rollover did not run in time.
+func (o certOptions) renew(s *selfsigned.SelfSignedCert, dnsNames []string) error {
+	// An unusable ca is replaced too
+	caKey, err := parsePrivateKey(s.CAKey)
+	var caCert *x509.Certificate
+	if err == nil {
+		caCert, err = signingCert(s.CACert, caKey)
+	}
+	if err != nil || time.Now().Add(o.renewBefore).After(caCert.NotAfter) {
+		renewed, err := o.newSelfSignedCert(dnsNames)
+		if err != nil {
+			return err
+		}
+		*s = *renewed
+		return nil
+	}
+	tlsCert, tlsKey, err := o.newTLS(s.Signer, dnsNames)
+	if err != nil {
+		return err
+	}
+	s.TLSCert = tlsCert
+	s.TLSKey = tlsKey
+	return nil
+}
+
+// certProblem is why certs failed validation. Problems that wait may resolve on their own, the others
+// need the certs to be regenerated.
+type certProblem struct {
+	reason string
+	wait   bool
+	err    error
+}
+
+func (p *certProblem) Error() string {
+	return fmt.Sprintf("%s: %s", p.reason, p.err)
+}
+
+// validateCerts checks that the tls key belongs to the tls cert, the tls cert is issued by the ca, it is
+// valid for every dns name and that the chain is still valid at the given time. The ca key is checked
+// to belong to the ca cert when given. Without a ca cert, eg when the cert-manager CA injector manages
+// the caBundle and the issuer leaves ca.crt empty, only the tls cert itself is checked.
+func validateCerts(caKey, caCert, tlsKey, tlsCert []byte, dnsNames []string, at time.Time) *certProblem {
+	var roots *x509.CertPool
+	if caCert != nil {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caCert) {
+			return &certProblem{reason: "CACertUnparsable", err: fmt.Errorf("failed to parse root certificate")}
+		}
+	}
+	if caKey != nil {
+		key, err := parsePrivateKey(caKey)
+		if err != nil {
+			return &certProblem{reason: "CAKeyUnparsable", err: err}
+		}
+		if _, err := signingCert(caCert, key); err != nil {
+			return &certProblem{reason: "CAKeyMismatch", err: err}
+		}
+	}
+
+	cert, err := x509Cert(tlsCert)
+	if err != nil {
+		return &certProblem{reason: "TLSCertUnparsable", err: err}
+	}
+	if _, err := tls.X509KeyPair(tlsCert, tlsKey); err != nil {
+		return &certProblem{reason: "TLSKeyMismatch", err: err}
+	}
+	if time.Now().Before(cert.NotBefore) {
+		return &certProblem{reason: "TLSCertNotYetValid", wait: true, err: fmt.Errorf("valid from %s", cert.NotBefore.Format(time.RFC3339))}
+	}
+
+	if roots == nil {
+		if at.After(cert.NotAfter) {
+			return &certProblem{reason: "TLSCertExpiring", err: fmt.Errorf("expires at %s", cert.NotAfter.Format(time.RFC3339))}
+		}
+	} else if _, err := cert.Verify(x509.VerifyOptions{CurrentTime: at, Roots: roots}); err != nil {
+		if at.After(cert.NotAfter) {
+			return &certProblem{reason: "TLSCertExpiring", err: fmt.Errorf("expires at %s", cert.NotAfter.Format(time.RFC3339))}
+		}
+		if invalid, ok := err.(x509.CertificateInvalidError); ok && invalid.Reason == x509.Expired {
+			return &certProblem{reason: "CACertExpiring", err: err}
+		}
+		return &certProblem{reason: "TLSCertUntrusted", err: err}
+	}
+	for _, dnsName := range dnsNames {
+		if err := cert.VerifyHostname(dnsName); err != nil {
+			return &certProblem{reason: "DNSNameMissing", err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testCerts are the arguments of validateCerts
+type testCerts struct {
+	caKey, caCert, tlsKey, tlsCert []byte
+	dnsNames                       []string
+	at                             time.Time
+}
+
+func TestValidateCerts(t *testing.T) {
+	opts := testCertOptions()
+	certs, err := opts.newSelfSignedCert(testDNSNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := opts.newSelfSignedCert(testDNSNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// change makes the valid certs invalid
+		change     func(c *testCerts)
+		wantReason string
+	}{
+		{
+			name:   "valid",
+			change: func(c *testCerts) {},
+		},
+		{
+			name:   "valid without the ca key",
+			change: func(c *testCerts) { c.caKey = nil },
+		},
+		{
+			// A bundle of the old and the new ca trusts the certs of either during a rollover
+			name: "ca bundle",
+			change: func(c *testCerts) {
+				c.caKey, c.caCert = nil, append(append([]byte{}, other.CACert...), certs.CACert...)
+			},
+		},
+		{
+			// The CA injector sets the caBundle when the issuer leaves ca.crt empty
+			name:   "valid without the ca",
+			change: func(c *testCerts) { c.caKey, c.caCert, c.tlsKey, c.tlsCert = nil, nil, other.TLSKey, other.TLSCert },
+		},
+		{
+			name:       "tls cert expired at the time without the ca",
+			change:     func(c *testCerts) { c.caKey, c.caCert, c.at = nil, nil, c.at.Add(opts.validity+time.Hour) },
+			wantReason: "TLSCertExpiring",
+		},
+		{
+			name:       "dns name missing without the ca",
+			change:     func(c *testCerts) { c.caKey, c.caCert, c.dnsNames = nil, nil, append(c.dnsNames, "other.example.com") },
+			wantReason: "DNSNameMissing",
+		},
+		{
+			name:       "empty ca cert",
+			change:     func(c *testCerts) { c.caKey, c.caCert = nil, []byte{} },
+			wantReason: "CACertUnparsable",
+		},
+		{
+			name:       "ca cert unparsable",
+			change:     func(c *testCerts) { c.caCert = []byte("not a cert") },
+			wantReason: "CACertUnparsable",
+		},
+		{
+			name:       "ca key unparsable",
+			change:     func(c *testCerts) { c.caKey = []byte("not a key") },
+			wantReason: "CAKeyUnparsable",
+		},
+		{
+			name:       "ca key of another ca",
+			change:     func(c *testCerts) { c.caKey = other.CAKey },
+			wantReason: "CAKeyMismatch",
+		},
+		{
+			name:       "tls cert unparsable",
+			change:     func(c *testCerts) { c.tlsCert = []byte("not a cert") },
+			wantReason: "TLSCertUnparsable",
+		},
+		{
+			name:       "tls key of another cert",
+			change:     func(c *testCerts) { c.tlsKey = other.TLSKey },
+			wantReason: "TLSKeyMismatch",
+		},
+		{
+			name:       "tls cert expired at the time",
+			change:     func(c *testCerts) { c.at = c.at.Add(opts.validity + time.Hour) },
+			wantReason: "TLSCertExpiring",
+		},
+		{
+			name:       "tls cert issued by another ca",
+			change:     func(c *testCerts) { c.tlsKey, c.tlsCert = other.TLSKey, other.TLSCert },
+			wantReason: "TLSCertUntrusted",
+		},
+		{
+			name:       "dns name missing",
+			change:     func(c *testCerts) { c.dnsNames = append(c.dnsNames, "other.example.com") },
+			wantReason: "DNSNameMissing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCerts{
+				caKey:    certs.CAKey,
+				caCert:   certs.CACert,
+				tlsKey:   certs.TLSKey,
+				tlsCert:  certs.TLSCert,
+				dnsNames: append([]string{}, testDNSNames...),
+				at:       time.Now(),
+			}
+			tt.change(&c)
+			problem := validateCerts(c.caKey, c.caCert, c.tlsKey, c.tlsCert, c.dnsNames, c.at)
+			if tt.wantReason == "" {
+				if problem != nil {
+					t.Errorf("problem = %s, want none", problem)
+				}
+				return
+			}
+			if problem == nil || problem.reason != tt.wantReason {
+				t.Errorf("problem = %v, want %s", problem, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// newEventRecorder returns a recorder that writes events to the API server
+func newEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "terraform-operator-plugin-manager"})
+}
+
+// deploymentRef refers to the manager's deployment
+func (m Manager) deploymentRef() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       m.deploymentName,
+		Namespace:  m.namespace,
+	}
+}
+
+// fail reports a persistent failure as a warning event on the deployment and marks the manager not ready
+func (m Manager) fail(reason string, err error) {
+	logger.Error(err, "Failed", "reason", reason)
+	m.recorder.Event(m.deploymentRef(), corev1.EventTypeWarning, reason, err.Error())
+	m.readiness.set(err)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/galleybytes/terraform-operator-plugin-manager/internal/webserver"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchSecret starts an informer on the cert secret. Changes to the secret wake up the cert management
+// loop so rotated certs are served right away instead of after kubelet syncs a mounted secret.
+func (m *Manager) watchSecret() error {
+	factory := informers.NewSharedInformerFactoryWithOptions(m.clientset, 0,
+		informers.WithNamespace(m.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", m.secretName).String()
+		}),
+	)
+	secretInformer := factory.Core().V1().Secrets()
+	_, err := secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { m.wake() },
+		UpdateFunc: func(interface{}, interface{}) { m.wake() },
+		DeleteFunc: func(interface{}) { m.wake() },
+	})
+	if err != nil {
+		return err
+	}
+	m.secretLister = secretInformer.Lister()
+
+	factory.Start(m.ctx.Done())
+	if !cache.WaitForCacheSync(m.ctx.Done(), secretInformer.Informer().HasSynced) {
+		return fmt.Errorf("failed to sync the informer for 'secret/%s'", m.secretName)
+	}
+	logger.Info("Watching the secret for certs", "secret", m.secretName)
+	return nil
+}
+
+// cachedSecret returns a copy of the secret from the informer's cache
+func (m Manager) cachedSecret() (*corev1.Secret, error) {
+	secret, err := m.secretLister.Secrets(m.namespace).Get(m.secretName)
+	if err != nil {
+		return nil, err
+	}
+	return secret.DeepCopy(), nil
+}
+
+// watchNamespaces starts an informer on namespaces so the webserver reads their plugin settings from a
+// cache instead of the API server on every admission request
+func (m Manager) watchNamespaces() (corelisters.NamespaceLister, error) {
+	factory := informers.NewSharedInformerFactory(m.clientset, 0)
+	namespaceInformer := factory.Core().V1().Namespaces()
+	// The informer must be requested before the factory is started
+	lister := namespaceInformer.Lister()
+
+	factory.Start(m.ctx.Done())
+	if !cache.WaitForCacheSync(m.ctx.Done(), namespaceInformer.Informer().HasSynced) {
+		return nil, fmt.Errorf("failed to sync the namespace informer")
+	}
+	return lister, nil
+}
+
+// watchNamespacePlugins starts an informer on the ConfigMaps that define plugins for their namespace
+func (m Manager) watchNamespacePlugins() (corelisters.ConfigMapLister, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(m.clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = webserver.NamespacePluginsLabel + "=true"
+		}),
+	)
+	configMapInformer := factory.Core().V1().ConfigMaps()
+	// The informer must be requested before the factory is started
+	lister := configMapInformer.Lister()
+
+	factory.Start(m.ctx.Done())
+	if !cache.WaitForCacheSync(m.ctx.Done(), configMapInformer.Informer().HasSynced) {
+		return nil, fmt.Errorf("failed to sync the namespace plugin informer")
+	}
+	return lister, nil
+}
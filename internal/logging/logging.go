@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// levels maps the log level names to logr verbosity. Messages logged with V(1) are only shown at the
+// debug level.
+var levels = map[string]int{
+	"info":  0,
+	"debug": 1,
+}
+
+// New returns a logger that writes to stderr in the format, text or json, and only logs messages at or
+// below the level, info or debug
+func New(format, level string) (logr.Logger, error) {
+	verbosity, ok := levels[level]
+	if !ok {
+		return logr.Discard(), fmt.Errorf("unknown log level '%s'", level)
+	}
+	opts := funcr.Options{
+		LogTimestamp:    true,
+		TimestampFormat: time.RFC3339,
+		Verbosity:       verbosity,
+	}
+	switch format {
+	case FormatText:
+		return funcr.New(func(prefix, args string) {
+			if prefix != "" {
+				fmt.Fprintln(os.Stderr, prefix+": "+args)
+				return
+			}
+			fmt.Fprintln(os.Stderr, args)
+		}, opts), nil
+	case FormatJSON:
+		return funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, opts), nil
+	default:
+		return logr.Discard(), fmt.Errorf("unknown log format '%s'", format)
+	}
+}
@@ -0,0 +1,305 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	"github.com/mattbaird/jsonpatch"
+	admission "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// redacted replaces the values of secret env vars in audit records
+const redacted = "REDACTED"
+
+// AuditRecord is the record of a single admission response
+type AuditRecord struct {
+	Time      time.Time                     `json:"time"`
+	UID       types.UID                     `json:"uid"`
+	Operation admission.Operation           `json:"operation"`
+	UserInfo  authenticationv1.UserInfo     `json:"userInfo"`
+	Object    AuditObjectRef                `json:"object"`
+	DryRun    bool                          `json:"dryRun,omitempty"`
+	Allowed   bool                          `json:"allowed"`
+	Message   string                        `json:"message,omitempty"`
+	Warnings  []string                      `json:"warnings,omitempty"`
+	Applied   []tfv1beta1.TaskName          `json:"applied"`
+	Skipped   []tfv1beta1.TaskName          `json:"skipped"`
+	Plugins   map[tfv1beta1.TaskName]string `json:"plugins"`
+	// Patch is the patch that was returned with the values of secret env vars redacted
+	Patch json.RawMessage `json:"patch"`
+}
+
+// AuditObjectRef refers to the Terraform of the admission request
+type AuditObjectRef struct {
+	Resource  metav1.GroupVersionResource `json:"resource"`
+	Namespace string                      `json:"namespace"`
+	Name      string                      `json:"name"`
+}
+
+// AuditSink persists audit records. Records are written in the order of the admission responses by a
+// single writer, after the responses were returned. Close is called once the server stopped.
+type AuditSink interface {
+	Write(ctx context.Context, record AuditRecord) error
+	Close() error
+}
+
+// writerAuditSink writes audit records as JSON lines
+type writerAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+	// closer is closed with the sink, it is nil when the writer is not owned by the sink
+	closer io.Closer
+}
+
+func (s *writerAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *writerAuditSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// NewStdoutAuditSink writes audit records to stdout as JSON lines
+func NewStdoutAuditSink() AuditSink {
+	return &writerAuditSink{w: os.Stdout}
+}
+
+// NewFileAuditSink appends audit records to the file as JSON lines. The file is closed with the sink.
+func NewFileAuditSink(filename string) (AuditSink, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file '%s': %s", filename, err)
+	}
+	return &writerAuditSink{w: file, closer: file}, nil
+}
+
+// httpAuditSink posts each audit record as JSON to an endpoint
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPAuditSink posts each audit record as JSON to the url. Any status other than 2xx is an error.
+func NewHTTPAuditSink(url string, timeout time.Duration) AuditSink {
+	return &httpAuditSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *httpAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *httpAuditSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// asyncAuditSink buffers audit records and writes them to the sink in the background so admission
+// responses never wait for the sink. Records are dropped while the buffer is full.
+type asyncAuditSink struct {
+	sink    AuditSink
+	records chan AuditRecord
+	// done is closed once every buffered record was written or dropped
+	done chan struct{}
+	// ctx is passed to the sink's writes, it is canceled when the records are not drained in time
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAsyncAuditSink(sink AuditSink, size int) *asyncAuditSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &asyncAuditSink{
+		sink:    sink,
+		records: make(chan AuditRecord, size),
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go s.run()
+	return s
+}
+
+// add buffers the record, or drops it when the buffer is full or the sink is closed
+func (s *asyncAuditSink) add(record AuditRecord) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		countAuditRecord("dropped")
+		return
+	}
+	select {
+	case s.records <- record:
+	default:
+		countAuditRecord("dropped")
+		logger.Info("Dropping audit record, the audit buffer is full", "uid", record.UID, "bufferSize", cap(s.records))
+	}
+}
+
+func (s *asyncAuditSink) run() {
+	defer close(s.done)
+	for record := range s.records {
+		if s.ctx.Err() != nil {
+			countAuditRecord("dropped")
+			continue
+		}
+		if err := s.sink.Write(s.ctx, record); err != nil {
+			countAuditRecord("failed")
+			logger.Error(err, "Failed to write audit record", "uid", record.UID)
+			continue
+		}
+		countAuditRecord("written")
+	}
+}
+
+// close writes the buffered records until the context is done, then cancels the write in flight, drops
+// the rest and closes the sink
+func (s *asyncAuditSink) close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	close(s.records)
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		logger.Info("Dropping audit records that were not written in time", "buffered", len(s.records))
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+	return s.sink.Close()
+}
+
+// secretEnv holds the env var name patterns of every loaded plugin whose values are redacted
+type secretEnv []string
+
+func (s secretEnv) matches(name string) bool {
+	for _, pattern := range s {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redactPatch returns the patch with the values of secret env vars replaced. The names of env vars that
+// are only patched by value are looked up in the patched object.
+func redactPatch(patch []jsonpatch.JsonPatchOperation, target []byte, secrets secretEnv) ([]byte, error) {
+	if len(secrets) == 0 {
+		return json.Marshal(patch)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(target, &doc); err != nil {
+		return nil, err
+	}
+
+	redactedPatch := make([]jsonpatch.JsonPatchOperation, len(patch))
+	for i, op := range patch {
+		// Normalize the value so env vars in it can be found no matter how it was built
+		var value interface{}
+		if op.Value != nil {
+			b, err := json.Marshal(op.Value)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(b, &value); err != nil {
+				return nil, err
+			}
+		}
+		segments := strings.Split(op.Path, "/")
+		if n := len(segments); n >= 3 && segments[n-1] == "value" && segments[n-3] == "env" {
+			// The value of a single env var
+			if name, ok := lookup(doc, append(segments[1:n-1], "name")).(string); ok && secrets.matches(name) {
+				value = redacted
+			}
+		} else {
+			value = redactEnv(value, secrets)
+		}
+		redactedPatch[i] = jsonpatch.JsonPatchOperation{Operation: op.Operation, Path: op.Path, Value: value}
+	}
+	return json.Marshal(redactedPatch)
+}
+
+// redactEnv replaces the values of secret env vars anywhere in the value
+func redactEnv(value interface{}, secrets secretEnv) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok && secrets.matches(name) {
+			if _, ok := v["value"]; ok {
+				v["value"] = redacted
+			}
+		}
+		for key, child := range v {
+			v[key] = redactEnv(child, secrets)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactEnv(child, secrets)
+		}
+	}
+	return value
+}
+
+// lookup returns the value at the JSON pointer segments, or nil when it does not exist
+func lookup(doc interface{}, segments []string) interface{} {
+	for _, segment := range segments {
+		segment = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			doc = v[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			doc = v[i]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
@@ -0,0 +1,162 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/mattbaird/jsonpatch"
+)
+
+func TestRedactPatch(t *testing.T) {
+	target := `{"spec": {"taskOptions": [{"env": [{"name": "LOG_LEVEL", "value": "debug"}, {"name": "API_TOKEN", "value": "s3cret"}]}]}}`
+	tests := []struct {
+		name    string
+		secrets secretEnv
+		patch   []jsonpatch.JsonPatchOperation
+		want    string
+	}{
+		{
+			name:    "no secrets",
+			secrets: secretEnv{},
+			patch:   []jsonpatch.JsonPatchOperation{{Operation: "replace", Path: "/spec/taskOptions/0/env/1/value", Value: "s3cret"}},
+			want:    `[{"op":"replace","path":"/spec/taskOptions/0/env/1/value","value":"s3cret"}]`,
+		},
+		{
+			name:    "value of a secret env var",
+			secrets: secretEnv{"API_*"},
+			patch:   []jsonpatch.JsonPatchOperation{{Operation: "replace", Path: "/spec/taskOptions/0/env/1/value", Value: "s3cret"}},
+			want:    `[{"op":"replace","path":"/spec/taskOptions/0/env/1/value","value":"REDACTED"}]`,
+		},
+		{
+			name:    "value of another env var",
+			secrets: secretEnv{"API_*"},
+			patch:   []jsonpatch.JsonPatchOperation{{Operation: "replace", Path: "/spec/taskOptions/0/env/0/value", Value: "debug"}},
+			want:    `[{"op":"replace","path":"/spec/taskOptions/0/env/0/value","value":"debug"}]`,
+		},
+		{
+			name:    "secret env var added",
+			secrets: secretEnv{"API_TOKEN"},
+			patch: []jsonpatch.JsonPatchOperation{{Operation: "add", Path: "/spec/taskOptions/0/env/1", Value: map[string]interface{}{
+				"name": "API_TOKEN", "value": "s3cret",
+			}}},
+			want: `[{"op":"add","path":"/spec/taskOptions/0/env/1","value":{"name":"API_TOKEN","value":"REDACTED"}}]`,
+		},
+		{
+			name:    "secret env var in an added task option",
+			secrets: secretEnv{"API_TOKEN"},
+			patch: []jsonpatch.JsonPatchOperation{{Operation: "add", Path: "/spec/taskOptions", Value: []interface{}{map[string]interface{}{
+				"env": []interface{}{
+					map[string]interface{}{"name": "LOG_LEVEL", "value": "debug"},
+					map[string]interface{}{"name": "API_TOKEN", "value": "s3cret"},
+				},
+			}}}},
+			want: `[{"op":"add","path":"/spec/taskOptions","value":[{"env":[{"name":"LOG_LEVEL","value":"debug"},{"name":"API_TOKEN","value":"REDACTED"}]}]}]`,
+		},
+		{
+			name:    "secret env var from a secret ref is kept",
+			secrets: secretEnv{"API_TOKEN"},
+			patch: []jsonpatch.JsonPatchOperation{{Operation: "add", Path: "/spec/taskOptions/0/env/1", Value: map[string]interface{}{
+				"name": "API_TOKEN", "valueFrom": map[string]interface{}{"secretKeyRef": map[string]interface{}{"name": "api", "key": "token"}},
+			}}},
+			want: `[{"op":"add","path":"/spec/taskOptions/0/env/1","value":{"name":"API_TOKEN","valueFrom":{"secretKeyRef":{"key":"token","name":"api"}}}}]`,
+		},
+		{
+			name:    "removed value",
+			secrets: secretEnv{"API_TOKEN"},
+			patch:   []jsonpatch.JsonPatchOperation{{Operation: "remove", Path: "/spec/taskOptions/0/env/1"}},
+			want:    `[{"op":"remove","path":"/spec/taskOptions/0/env/1"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redactPatch(tt.patch, []byte(target), tt.secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotValue, wantValue interface{}
+			if err := json.Unmarshal(got, &gotValue); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("redactPatch() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// testAuditSink records the uids of the written records. Writes signal started and block until write
+// is closed.
+type testAuditSink struct {
+	started chan struct{}
+	write   chan struct{}
+	written []string
+	closed  bool
+}
+
+func newTestAuditSink() *testAuditSink {
+	return &testAuditSink{started: make(chan struct{}, 10), write: make(chan struct{})}
+}
+
+func (s *testAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	s.started <- struct{}{}
+	select {
+	case <-s.write:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.written = append(s.written, string(record.UID))
+	return nil
+}
+
+func (s *testAuditSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestAsyncAuditSink(t *testing.T) {
+	sink := newTestAuditSink()
+	async := newAsyncAuditSink(sink, 2)
+	// The first record is taken by the writer, which waits on the sink, and two more are buffered
+	async.add(AuditRecord{UID: "1"})
+	<-sink.started
+	async.add(AuditRecord{UID: "2"})
+	async.add(AuditRecord{UID: "3"})
+	async.add(AuditRecord{UID: "4"})
+
+	close(sink.write)
+	if err := async.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(sink.written, want) {
+		t.Errorf("written = %v, want %v", sink.written, want)
+	}
+	if !sink.closed {
+		t.Error("sink was not closed")
+	}
+	// Records of requests that finish after the server stopped are dropped
+	async.add(AuditRecord{UID: "5"})
+}
+
+func TestAsyncAuditSinkCloseTimeout(t *testing.T) {
+	sink := newTestAuditSink()
+	async := newAsyncAuditSink(sink, 2)
+	async.add(AuditRecord{UID: "1"})
+	async.add(AuditRecord{UID: "2"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := async.close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.written) != 0 {
+		t.Errorf("written = %v, want none", sink.written)
+	}
+	if !sink.closed {
+		t.Error("sink was not closed")
+	}
+}
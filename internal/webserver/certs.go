@@ -0,0 +1,113 @@
+package webserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyPairReloader serves the key pair from the cert and key files and reloads it when the files change,
+// so a rotated serving cert is used without restarting the server
+type keyPairReloader struct {
+	certFilename string
+	keyFilename  string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+func (k *keyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	modTime := time.Time{}
+	for _, filename := range []string{k.certFilename, k.keyFilename} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cert != nil && modTime.Equal(k.modTime) {
+		return k.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFilename, k.keyFilename)
+	if err != nil {
+		// The files may be mid-update, keep serving the last key pair
+		if k.cert != nil {
+			logger.Error(err, "Failed to reload serving cert, using the previous one")
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	if k.cert != nil {
+		logger.Info("Reloaded serving cert", "file", k.certFilename)
+	}
+	k.cert = &cert
+	k.modTime = modTime
+	return k.cert, nil
+}
+
+// ServingCert is the key pair the server presents. It is read from the mounted files unless it is set
+// in memory, which is used when the files never catch up with the secret they are mounted from.
+type ServingCert struct {
+	files *keyPairReloader
+
+	mu       sync.Mutex
+	certPEM  []byte
+	inMemory *tls.Certificate
+}
+
+// NewServingCert serves the key pair from the cert and key files
+func NewServingCert(certFilename, keyFilename string) *ServingCert {
+	return &ServingCert{
+		files: &keyPairReloader{
+			certFilename: certFilename,
+			keyFilename:  keyFilename,
+		},
+	}
+}
+
+// Set serves the key pair from memory instead of the files
+func (s *ServingCert) Set(certPEM, keyPEM []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inMemory != nil && bytes.Equal(s.certPEM, certPEM) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	logger.Info("Serving cert from memory")
+	s.certPEM = certPEM
+	s.inMemory = &cert
+	return nil
+}
+
+// UseFiles goes back to serving the key pair from the files
+func (s *ServingCert) UseFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inMemory != nil {
+		logger.Info("Serving cert from file", "file", s.files.certFilename)
+	}
+	s.certPEM = nil
+	s.inMemory = nil
+}
+
+func (s *ServingCert) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	cert := s.inMemory
+	s.mu.Unlock()
+	if cert != nil {
+		return cert, nil
+	}
+	return s.files.GetCertificate(hello)
+}
@@ -0,0 +1,164 @@
+package webserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+)
+
+// pluginConditions limit a plugin to the Terraforms whose spec matches every condition that is set
+type pluginConditions struct {
+	// BackendContains only applies the plugin when spec.backend contains the string
+	BackendContains string `json:"backendContains"`
+	// TasksConfigured only applies the plugin when spec.taskOptions configures one of the tasks, either
+	// by name or with `*`
+	TasksConfigured []tfv1beta1.TaskName `json:"tasksConfigured"`
+	// TerraformVersion only applies the plugin when spec.terraformVersion is in the range, eg
+	// `>= 1.3.0, < 2.0.0`. Terraforms without a version do not match.
+	TerraformVersion string `json:"terraformVersion"`
+}
+
+// validate checks that the conditions can be evaluated
+func (c pluginConditions) validate() error {
+	if c.TerraformVersion == "" {
+		return nil
+	}
+	_, err := parseVersionConstraints(c.TerraformVersion)
+	return err
+}
+
+// match checks the Terraform against the conditions. The reason describes the first condition that
+// did not match.
+func (c pluginConditions) match(tf *tfv1beta1.Terraform) (bool, string) {
+	if c.BackendContains != "" && !strings.Contains(tf.Spec.Backend, c.BackendContains) {
+		return false, fmt.Sprintf("backend does not contain '%s'", c.BackendContains)
+	}
+	if len(c.TasksConfigured) > 0 && !tasksConfigured(tf, c.TasksConfigured) {
+		return false, fmt.Sprintf("none of the tasks '%s' are configured", joinTaskNames(c.TasksConfigured))
+	}
+	if c.TerraformVersion != "" {
+		constraints, err := parseVersionConstraints(c.TerraformVersion)
+		if err != nil {
+			return false, err.Error()
+		}
+		version, err := parseVersion(tf.Spec.TerraformVersion)
+		if err != nil {
+			return false, fmt.Sprintf("terraformVersion '%s' is not a version", tf.Spec.TerraformVersion)
+		}
+		if !constraints.allow(version) {
+			return false, fmt.Sprintf("terraformVersion '%s' is not '%s'", tf.Spec.TerraformVersion, c.TerraformVersion)
+		}
+	}
+	return true, ""
+}
+
+func tasksConfigured(tf *tfv1beta1.Terraform, tasks []tfv1beta1.TaskName) bool {
+	for _, taskOption := range tf.Spec.TaskOptions {
+		for _, configured := range taskOption.For {
+			if configured == "*" {
+				return true
+			}
+			for _, task := range tasks {
+				if configured == task {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// version is a numeric dotted version, missing parts are zero
+type version [3]int
+
+// parseVersion parses versions like `1.3`, `v1.3.7` and `1.4.0-rc1`. Pre-release and build suffixes are
+// ignored.
+func parseVersion(s string) (version, error) {
+	var v version
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if s == "" || len(parts) > len(v) {
+		return v, fmt.Errorf("invalid version '%s'", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version '%s'", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v version) compare(other version) int {
+	for i := range v {
+		if v[i] != other[i] {
+			if v[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+type versionConstraint struct {
+	op      string
+	version version
+}
+
+// versionConstraints are comma separated constraints that must all allow a version
+type versionConstraints []versionConstraint
+
+// parseVersionConstraints parses constraints like `>= 1.3.0, < 2`. The operators are =, !=, >, >=, <
+// and <=, a version without an operator must be equal.
+func parseVersionConstraints(s string) (versionConstraints, error) {
+	constraints := versionConstraints{}
+	for _, clause := range strings.Split(s, ",") {
+		clause = strings.TrimSpace(clause)
+		op := "="
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(clause, candidate) {
+				op = candidate
+				clause = strings.TrimPrefix(clause, candidate)
+				break
+			}
+		}
+		v, err := parseVersion(clause)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint '%s': %s", s, err)
+		}
+		constraints = append(constraints, versionConstraint{op: op, version: v})
+	}
+	return constraints, nil
+}
+
+func (c versionConstraints) allow(v version) bool {
+	for _, constraint := range c {
+		cmp := v.compare(constraint.version)
+		var ok bool
+		switch constraint.op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
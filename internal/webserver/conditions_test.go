@@ -0,0 +1,266 @@
+package webserver
+
+import (
+	"reflect"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    version
+		wantErr bool
+	}{
+		{s: "1", want: version{1, 0, 0}},
+		{s: "1.3", want: version{1, 3, 0}},
+		{s: "1.3.7", want: version{1, 3, 7}},
+		{s: "v1.3.7", want: version{1, 3, 7}},
+		{s: " 1.3.7 ", want: version{1, 3, 7}},
+		{s: "1.4.0-rc1", want: version{1, 4, 0}},
+		{s: "1.4.0+build.5", want: version{1, 4, 0}},
+		{s: "", wantErr: true},
+		{s: "1.2.3.4", wantErr: true},
+		{s: "1.x", wantErr: true},
+		{s: "1..2", wantErr: true},
+		{s: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			v, err := parseVersion(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && v != tt.want {
+				t.Errorf("parseVersion() = %v, want %v", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVersionConstraints(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    versionConstraints
+		wantErr string
+	}{
+		{
+			s:    "1.3.0",
+			want: versionConstraints{{op: "=", version: version{1, 3, 0}}},
+		},
+		{
+			s:    ">= 1.3.0, < 2",
+			want: versionConstraints{{op: ">=", version: version{1, 3, 0}}, {op: "<", version: version{2, 0, 0}}},
+		},
+		{
+			s: "=1,!=1.1,>1.2,>=1.3,<1.4,<=1.5",
+			want: versionConstraints{
+				{op: "=", version: version{1, 0, 0}},
+				{op: "!=", version: version{1, 1, 0}},
+				{op: ">", version: version{1, 2, 0}},
+				{op: ">=", version: version{1, 3, 0}},
+				{op: "<", version: version{1, 4, 0}},
+				{op: "<=", version: version{1, 5, 0}},
+			},
+		},
+		{
+			s:       ">= 1.3.0,",
+			wantErr: "invalid version constraint '>= 1.3.0,': invalid version ''",
+		},
+		{
+			s:       "~> 1.3",
+			wantErr: "invalid version constraint '~> 1.3': invalid version '~> 1.3'",
+		},
+		{
+			s:       "=> 1.3",
+			wantErr: "invalid version constraint '=> 1.3': invalid version '> 1.3'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			constraints, err := parseVersionConstraints(tt.s)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(constraints, tt.want) {
+				t.Errorf("parseVersionConstraints() = %v, want %v", constraints, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionConstraintsAllow(t *testing.T) {
+	tests := []struct {
+		constraints string
+		allowed     []string
+		denied      []string
+	}{
+		{constraints: "1.3", allowed: []string{"1.3.0", "v1.3"}, denied: []string{"1.3.1", "1.2.9"}},
+		{constraints: "= 1.3.0", allowed: []string{"1.3.0"}, denied: []string{"1.3.1"}},
+		{constraints: "!= 1.3.0", allowed: []string{"1.2.9", "1.3.1"}, denied: []string{"1.3.0"}},
+		{constraints: "> 1.3.0", allowed: []string{"1.3.1", "2.0.0"}, denied: []string{"1.3.0", "1.2.99"}},
+		{constraints: ">= 1.3.0", allowed: []string{"1.3.0", "1.10.0"}, denied: []string{"1.2.10"}},
+		{constraints: "< 1.3.0", allowed: []string{"1.2.10", "0.15.5"}, denied: []string{"1.3.0", "1.4.0"}},
+		{constraints: "<= 1.3.0", allowed: []string{"1.3.0", "1.2.0"}, denied: []string{"1.3.1"}},
+		{constraints: ">= 1.3.0, < 2", allowed: []string{"1.3.0", "1.9.9"}, denied: []string{"1.2.0", "2.0.0"}},
+		// Pre-releases compare as their release
+		{constraints: ">= 1.4.0", allowed: []string{"1.4.0-rc1"}, denied: []string{"1.3.9-rc1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraints, func(t *testing.T) {
+			constraints, err := parseVersionConstraints(tt.constraints)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.allowed {
+				if v, _ := parseVersion(s); !constraints.allow(v) {
+					t.Errorf("%s is not allowed", s)
+				}
+			}
+			for _, s := range tt.denied {
+				if v, _ := parseVersion(s); constraints.allow(v) {
+					t.Errorf("%s is allowed", s)
+				}
+			}
+		})
+	}
+}
+
+func TestPluginConditionsMatch(t *testing.T) {
+	tf := &tfv1beta1.Terraform{}
+	tf.Spec.Backend = `terraform { backend "s3" {} }`
+	tf.Spec.TerraformVersion = "1.5.2"
+	tf.Spec.TaskOptions = []tfv1beta1.TaskOption{{For: []tfv1beta1.TaskName{"plan", "apply"}}}
+
+	tests := []struct {
+		name       string
+		conditions pluginConditions
+		wantReason string
+	}{
+		{name: "no conditions"},
+		{name: "backend", conditions: pluginConditions{BackendContains: `backend "s3"`}},
+		{name: "other backend", conditions: pluginConditions{BackendContains: `backend "gcs"`}, wantReason: `backend does not contain 'backend "gcs"'`},
+		{name: "task configured", conditions: pluginConditions{TasksConfigured: []tfv1beta1.TaskName{"init", "apply"}}},
+		{name: "task not configured", conditions: pluginConditions{TasksConfigured: []tfv1beta1.TaskName{"init"}}, wantReason: "none of the tasks 'init' are configured"},
+		{name: "version", conditions: pluginConditions{TerraformVersion: ">= 1.3.0, < 2"}},
+		{name: "other version", conditions: pluginConditions{TerraformVersion: "< 1.5"}, wantReason: "terraformVersion '1.5.2' is not '< 1.5'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, reason := tt.conditions.match(tf)
+			if matched != (tt.wantReason == "") || reason != tt.wantReason {
+				t.Errorf("match() = %v, %q, want reason %q", matched, reason, tt.wantReason)
+			}
+		})
+	}
+
+	noVersion := &tfv1beta1.Terraform{}
+	if matched, _ := (pluginConditions{TerraformVersion: ">= 1.3.0"}).match(noVersion); matched {
+		t.Error("Terraform without a version matched a version range")
+	}
+	allTasksConfigured := &tfv1beta1.Terraform{}
+	allTasksConfigured.Spec.TaskOptions = []tfv1beta1.TaskOption{{For: []tfv1beta1.TaskName{"*"}}}
+	if matched, _ := (pluginConditions{TasksConfigured: []tfv1beta1.TaskName{"init"}}).match(allTasksConfigured); !matched {
+		t.Error("task configured with '*' did not match")
+	}
+}
+
+func TestInjectedRecordSubmitted(t *testing.T) {
+	opts := []*pluginOption{mustParsePluginOption(t, "monitor", `{"extraTaskConfigs": [{"for": ["plan", "apply"]}]}`)}
+	tf := &tfv1beta1.Terraform{}
+	tf.Spec.TaskOptions = []tfv1beta1.TaskOption{
+		// The user's task options
+		{For: []tfv1beta1.TaskName{"init"}},
+		{For: []tfv1beta1.TaskName{"monitor", "plan"}},
+		// The task options of a plugin applied before, of one injected by an earlier admission and an
+		// extra task config added by an earlier admission
+		{For: []tfv1beta1.TaskName{"monitor"}},
+		{For: []tfv1beta1.TaskName{"setup"}},
+		{For: []tfv1beta1.TaskName{"apply", "plan"}},
+	}
+	record := injectedRecord{
+		Plugins:     map[tfv1beta1.TaskName]string{"setup": "sha256:0"},
+		TaskOptions: []injectedTaskOption{{Index: 4, Hash: taskOptionHash(tf.Spec.TaskOptions[4])}},
+	}
+
+	submitted := record.submitted(tf, opts)
+	want := []tfv1beta1.TaskOption{{For: []tfv1beta1.TaskName{"init"}}, {For: []tfv1beta1.TaskName{"monitor", "plan"}}}
+	if !reflect.DeepEqual(submitted.Spec.TaskOptions, want) {
+		t.Errorf("task options = %v, want %v", submitted.Spec.TaskOptions, want)
+	}
+	if len(tf.Spec.TaskOptions) != 5 {
+		t.Error("the Terraform was changed")
+	}
+
+	// Plugins only see the tasks the user configured
+	conditions := pluginConditions{TasksConfigured: []tfv1beta1.TaskName{"apply"}}
+	if matched, _ := conditions.match(submitted); matched {
+		t.Error("a task configured by the manager matched")
+	}
+}
+
+func TestInjectedRecordOwnedTaskOptions(t *testing.T) {
+	injected := tfv1beta1.TaskOption{For: []tfv1beta1.TaskName{"plan", "apply"}, RestartPolicy: corev1.RestartPolicyAlways}
+	record := injectedRecord{TaskOptions: []injectedTaskOption{{Index: 1, Hash: taskOptionHash(injected)}}}
+
+	tests := []struct {
+		name        string
+		taskOptions []tfv1beta1.TaskOption
+		want        map[int]bool
+	}{
+		{
+			name:        "at its index",
+			taskOptions: []tfv1beta1.TaskOption{{For: []tfv1beta1.TaskName{"init"}}, injected},
+			want:        map[int]bool{1: true},
+		},
+		{
+			name:        "moved by removing a task option before it",
+			taskOptions: []tfv1beta1.TaskOption{injected},
+			want:        map[int]bool{0: true},
+		},
+		{
+			name:        "a copy made by the user is not owned",
+			taskOptions: []tfv1beta1.TaskOption{injected, injected},
+			want:        map[int]bool{1: true},
+		},
+		{
+			name:        "changed by the user",
+			taskOptions: []tfv1beta1.TaskOption{{For: []tfv1beta1.TaskName{"init"}}, withRestartPolicy(injected, corev1.RestartPolicyNever)},
+			want:        map[int]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := &tfv1beta1.Terraform{}
+			tf.Spec.TaskOptions = tt.taskOptions
+			if owned := record.ownedTaskOptions(tf); !reflect.DeepEqual(owned, tt.want) {
+				t.Errorf("owned = %v, want %v", owned, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectedRecordUpdateTaskOptions(t *testing.T) {
+	tf := &tfv1beta1.Terraform{}
+	tf.Spec.TaskOptions = []tfv1beta1.TaskOption{
+		{For: []tfv1beta1.TaskName{"apply", "plan"}},
+		{For: []tfv1beta1.TaskName{"init"}},
+	}
+	record := injectedRecord{
+		Plugins:     map[tfv1beta1.TaskName]string{},
+		TaskOptions: []injectedTaskOption{{Index: 3, Hash: "sha256:0"}},
+	}
+	record.update(tf, nil, map[int]bool{1: true})
+	want := []injectedTaskOption{{Index: 1, Hash: taskOptionHash(tf.Spec.TaskOptions[1])}}
+	if !reflect.DeepEqual(record.TaskOptions, want) {
+		t.Errorf("task options = %v, want %v", record.TaskOptions, want)
+	}
+}
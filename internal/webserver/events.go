@@ -0,0 +1,176 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// terraformEventInterval is how often a Terraform is looked up until the API server has stored it
+	terraformEventInterval = 2 * time.Second
+	// terraformEventTimeout is how long a Terraform is looked up before its event is dropped
+	terraformEventTimeout = time.Minute
+	// terraformEventWorkers is how many Terraforms are looked up at the same time
+	terraformEventWorkers = 2
+	// terraformEventQueueSize is how many events can wait to be recorded. Events of later admissions
+	// are dropped while the queue is full.
+	terraformEventQueueSize = 1000
+)
+
+// terraformEvent is an event waiting for its Terraform to be stored
+type terraformEvent struct {
+	resource  schema.GroupVersionResource
+	namespace string
+	name      string
+	msg       string
+}
+
+// terraformEvents records events on the mutated Terraforms. The admission request is answered before
+// the Terraform is stored, so the events are queued and recorded by a fixed number of workers once the
+// Terraform can be found.
+type terraformEvents struct {
+	client   dynamic.Interface
+	recorder record.EventRecorder
+	queue    workqueue.RateLimitingInterface
+
+	mu sync.Mutex
+	// pending are the events that are queued or waiting to be retried
+	pending map[terraformEvent]bool
+}
+
+func newTerraformEvents(client dynamic.Interface, recorder record.EventRecorder) *terraformEvents {
+	return &terraformEvents{
+		client:   client,
+		recorder: recorder,
+		queue:    workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(terraformEventInterval, terraformEventInterval)),
+		pending:  map[terraformEvent]bool{},
+	}
+}
+
+// run records the queued events until the context is done. Events that are still pending are dropped.
+func (e *terraformEvents) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < terraformEventWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e.next(ctx) {
+			}
+		}()
+	}
+	<-ctx.Done()
+	e.queue.ShutDown()
+	wg.Wait()
+}
+
+// pluginsInjected records which plugins were injected into the Terraform and which of their task
+// options were merged into task options the Terraform already had
+func (e *terraformEvents) pluginsInjected(ar admission.AdmissionReview, applied, merged []tfv1beta1.TaskName) {
+	if e == nil || len(applied) == 0 {
+		return
+	}
+	log := logger.WithValues("uid", ar.Request.UID, "namespace", ar.Request.Namespace, "name", ar.Request.Name)
+	if ar.Request.DryRun != nil && *ar.Request.DryRun {
+		return
+	}
+	if ar.Request.Name == "" {
+		// Terraforms created with a generateName can not be looked up by name
+		log.V(1).Info("Not recording plugin event on a Terraform without a name")
+		return
+	}
+
+	msg := fmt.Sprintf("Injected plugins: %s", joinTaskNames(applied))
+	if len(merged) > 0 {
+		msg += fmt.Sprintf(". Merged into existing task options: %s", joinTaskNames(merged))
+	}
+	event := terraformEvent{
+		resource: schema.GroupVersionResource{
+			Group:    ar.Request.Resource.Group,
+			Version:  ar.Request.Resource.Version,
+			Resource: ar.Request.Resource.Resource,
+		},
+		namespace: ar.Request.Namespace,
+		name:      ar.Request.Name,
+		msg:       msg,
+	}
+	if !e.add(event) {
+		log.Info("Dropping plugin event, too many events are waiting to be recorded", "queueSize", terraformEventQueueSize)
+		countTerraformEvent("dropped")
+	}
+}
+
+// add queues the event unless the queue is full. The same event of another admission of the Terraform
+// is only recorded once.
+func (e *terraformEvents) add(event terraformEvent) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending[event] {
+		return true
+	}
+	if len(e.pending) >= terraformEventQueueSize {
+		return false
+	}
+	e.pending[event] = true
+	e.queue.Add(event)
+	return true
+}
+
+// next records the next queued event. It is retried until the Terraform is found or the event times
+// out. False is returned once the queue is shut down.
+func (e *terraformEvents) next(ctx context.Context) bool {
+	item, shutdown := e.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer e.queue.Done(item)
+	event := item.(terraformEvent)
+	if !e.record(ctx, event) {
+		if e.queue.NumRequeues(item) < int(terraformEventTimeout/terraformEventInterval) {
+			e.queue.AddRateLimited(item)
+			return true
+		}
+		logger.Info("Failed to record plugin event on the Terraform", "namespace", event.namespace, "name", event.name, "timeout", terraformEventTimeout.String())
+		countTerraformEvent("timeout")
+	}
+	e.queue.Forget(item)
+	e.mu.Lock()
+	delete(e.pending, event)
+	e.mu.Unlock()
+	return true
+}
+
+// record records the event when its Terraform is found
+func (e *terraformEvents) record(ctx context.Context, event terraformEvent) bool {
+	terraform, err := e.client.Resource(event.resource).Namespace(event.namespace).Get(ctx, event.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		logger.V(1).Info("Failed to get the Terraform to record an event on", "namespace", event.namespace, "name", event.name, "error", err.Error())
+		return false
+	}
+	e.recorder.Event(terraform, corev1.EventTypeNormal, "PluginsInjected", event.msg)
+	countTerraformEvent("recorded")
+	return true
+}
+
+func joinTaskNames(names []tfv1beta1.TaskName) string {
+	s := make([]string, len(names))
+	for i, name := range names {
+		s[i] = string(name)
+	}
+	return strings.Join(s, ", ")
+}
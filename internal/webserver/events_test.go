@@ -0,0 +1,73 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	admission "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPluginsInjectedEvent(t *testing.T) {
+	terraform := &unstructured.Unstructured{}
+	terraform.SetAPIVersion("tf.galleybytes.com/v1beta1")
+	terraform.SetKind("Terraform")
+	terraform.SetNamespace("default")
+	terraform.SetName("stack")
+	recorder := record.NewFakeRecorder(10)
+	events := newTerraformEvents(fake.NewSimpleDynamicClient(runtime.NewScheme(), terraform), recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go events.run(ctx)
+
+	ar := admission.AdmissionReview{Request: &admission.AdmissionRequest{
+		Namespace: "default",
+		Name:      "stack",
+		Resource:  metav1.GroupVersionResource{Group: "tf.galleybytes.com", Version: "v1beta1", Resource: "terraforms"},
+	}}
+	events.pluginsInjected(ar, []tfv1beta1.TaskName{"monitor", "setup"}, []tfv1beta1.TaskName{"setup"})
+	select {
+	case event := <-recorder.Events:
+		want := "Normal PluginsInjected Injected plugins: monitor, setup. Merged into existing task options: setup"
+		if event != want {
+			t.Errorf("event = %q, want %q", event, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not recorded")
+	}
+}
+
+func TestTerraformEventsQueueIsBounded(t *testing.T) {
+	events := newTerraformEvents(nil, nil)
+	defer events.queue.ShutDown()
+	event := func(i int) terraformEvent {
+		return terraformEvent{
+			resource:  schema.GroupVersionResource{Group: "tf.galleybytes.com", Version: "v1beta1", Resource: "terraforms"},
+			namespace: "default",
+			name:      fmt.Sprintf("stack-%d", i),
+			msg:       "Injected plugins: monitor",
+		}
+	}
+	for i := 0; i < terraformEventQueueSize; i++ {
+		if !events.add(event(i)) {
+			t.Fatalf("event %d was dropped before the queue was full", i)
+		}
+	}
+	if events.add(event(terraformEventQueueSize)) {
+		t.Error("event was queued while the queue was full")
+	}
+	if !events.add(event(0)) {
+		t.Error("event that is already queued was dropped")
+	}
+	if events.queue.Len() != terraformEventQueueSize {
+		t.Errorf("queued = %d, want %d", events.queue.Len(), terraformEventQueueSize)
+	}
+}
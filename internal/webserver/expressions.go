@@ -0,0 +1,118 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	"github.com/google/cel-go/cel"
+	admission "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	// expressionCostLimit stops expressions that would take too long to evaluate during admission
+	expressionCostLimit = 1000000
+	// compiledExpressionsSize is how many compiled expressions are kept. Namespace plugins are parsed
+	// for every admission request, so namespaces must not be able to grow the cache without bound.
+	compiledExpressionsSize = 1000
+	// compiledExpressionsTTL is how long a compiled expression is kept after it was compiled
+	compiledExpressionsTTL = time.Hour
+)
+
+var (
+	expressionEnvOnce sync.Once
+	expressionEnv     *cel.Env
+	expressionEnvErr  error
+
+	// compiledExpressions caches the programs by their expression, the least recently used are evicted
+	compiledExpressions = cache.NewLRUExpireCache(compiledExpressionsSize)
+)
+
+// newExpressionEnv declares the variables expressions are evaluated with:
+//   - object is the Terraform as it was submitted, without what the manager injected, see
+//     injectedRecord.submitted
+//   - request has the operation, namespace, name, dryRun and userInfo of the admission request
+func newExpressionEnv() (*cel.Env, error) {
+	expressionEnvOnce.Do(func() {
+		expressionEnv, expressionEnvErr = cel.NewEnv(
+			cel.Variable("object", cel.DynType),
+			cel.Variable("request", cel.DynType),
+		)
+	})
+	return expressionEnv, expressionEnvErr
+}
+
+// compileExpression compiles the expression into a program that must evaluate to a bool
+func compileExpression(expression string) (cel.Program, error) {
+	if program, ok := compiledExpressions.Get(expression); ok {
+		return program.(cel.Program), nil
+	}
+	env, err := newExpressionEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid expression '%s': %s", expression, issues.Err())
+	}
+	if !cel.BoolType.IsAssignableType(ast.OutputType()) {
+		return nil, fmt.Errorf("expression '%s' must evaluate to a bool, not %s", expression, ast.OutputType())
+	}
+	program, err := env.Program(ast, cel.CostLimit(expressionCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression '%s': %s", expression, err)
+	}
+	compiledExpressions.Add(expression, program, compiledExpressionsTTL)
+	return program, nil
+}
+
+// expressionVars returns the variables expressions are evaluated with for the admission request and the
+// submitted Terraform
+func expressionVars(ar admission.AdmissionReview, submitted *tfv1beta1.Terraform) (map[string]interface{}, error) {
+	b, err := json.Marshal(submitted)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(b, &object); err != nil {
+		return nil, err
+	}
+	groups := make([]interface{}, len(ar.Request.UserInfo.Groups))
+	for i, group := range ar.Request.UserInfo.Groups {
+		groups[i] = group
+	}
+	return map[string]interface{}{
+		"object": object,
+		"request": map[string]interface{}{
+			"operation": string(ar.Request.Operation),
+			"namespace": ar.Request.Namespace,
+			"name":      ar.Request.Name,
+			"dryRun":    ar.Request.DryRun != nil && *ar.Request.DryRun,
+			"userInfo": map[string]interface{}{
+				"username": ar.Request.UserInfo.Username,
+				"uid":      ar.Request.UserInfo.UID,
+				"groups":   groups,
+			},
+		},
+	}, nil
+}
+
+// evaluate checks if the plugin's expression is true. Plugins without an expression always apply.
+func (opt pluginOption) evaluate(vars map[string]interface{}) (bool, error) {
+	if opt.program == nil {
+		return true, nil
+	}
+	out, _, err := opt.program.Eval(vars)
+	if err != nil {
+		// Mostly a field the Terraform does not set, which must be checked with has()
+		return false, fmt.Errorf("failed to evaluate expression '%s', check optional fields with has(): %s", opt.Expression, err)
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression '%s' evaluated to %v, not a bool", opt.Expression, out.Value())
+	}
+	return result, nil
+}
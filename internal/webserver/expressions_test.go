@@ -0,0 +1,157 @@
+package webserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	admission "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCompileExpressionIsCached(t *testing.T) {
+	expression := `request.operation == "CREATE"`
+	program, err := compileExpression(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, ok := compiledExpressions.Get(expression); !ok || cached != program {
+		t.Fatal("the compiled expression was not cached")
+	}
+	again, err := compileExpression(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != program {
+		t.Error("the expression was compiled again")
+	}
+
+	// The least recently used expressions are evicted once the cache is full
+	for i := 0; i < compiledExpressionsSize; i++ {
+		if _, err := compileExpression(fmt.Sprintf("request.name == 'stack-%d'", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := compiledExpressions.Get(expression); ok {
+		t.Error("the cache grew beyond its size")
+	}
+}
+
+func TestCompileExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		wantErr    bool
+	}{
+		{expression: `object.metadata.name == "stack"`},
+		{expression: `object.metadata.name ==`, wantErr: true},
+		{expression: `"stack"`, wantErr: true},
+		{expression: `unknown.name == "stack"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := compileExpression(tt.expression); (err != nil) != tt.wantErr {
+			t.Errorf("compileExpression(%s) error = %v, want error %v", tt.expression, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	// Every element of the list is visited for every element, twice nested, which costs more than the
+	// limit
+	list := make([]string, 100)
+	for i := range list {
+		list[i] = fmt.Sprint(i)
+	}
+	expensive := fmt.Sprintf("%[1]s.all(a, %[1]s.all(b, %[1]s.all(c, a + b + c >= 0)))", "["+strings.Join(list, ", ")+"]")
+
+	tf := &tfv1beta1.Terraform{ObjectMeta: metav1.ObjectMeta{Name: "stack", Namespace: "team-a"}}
+	ar := admission.AdmissionReview{Request: &admission.AdmissionRequest{Operation: admission.Create, Namespace: "team-a", Name: "stack"}}
+	vars, err := expressionVars(ar, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		want       bool
+		wantErr    string
+	}{
+		{
+			name:       "no expression",
+			expression: "",
+			want:       true,
+		},
+		{
+			name:       "request and object",
+			expression: `request.operation == "CREATE" && object.metadata.namespace.startsWith("team-")`,
+			want:       true,
+		},
+		{
+			name:       "optional field checked with has",
+			expression: `has(object.metadata.labels) && object.metadata.labels.team == "platform"`,
+			want:       false,
+		},
+		{
+			name:       "optional field that is not set",
+			expression: `object.metadata.labels.team == "platform"`,
+			wantErr:    "check optional fields with has()",
+		},
+		{
+			name:       "cost limit",
+			expression: expensive,
+			wantErr:    "cost limit exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := mustParsePluginOption(t, "monitor", fmt.Sprintf(`{"expression": %q}`, tt.expression))
+			got, err := opt.evaluate(vars)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want it to contain %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressionVarsOnUpdate(t *testing.T) {
+	// The task option the manager added for an extra task config on create
+	injected := tfv1beta1.TaskOption{For: []tfv1beta1.TaskName{"apply"}, RestartPolicy: "Always"}
+	tf := &tfv1beta1.Terraform{ObjectMeta: metav1.ObjectMeta{Name: "stack", Namespace: "team-a"}}
+	tf.Spec.TaskOptions = []tfv1beta1.TaskOption{{For: []tfv1beta1.TaskName{"plan"}}, injected}
+	record := injectedRecord{
+		Plugins:     map[tfv1beta1.TaskName]string{},
+		TaskOptions: []injectedTaskOption{{Index: 1, Hash: taskOptionHash(injected)}},
+	}
+	ar := admission.AdmissionReview{Request: &admission.AdmissionRequest{Operation: admission.Update, Namespace: "team-a", Name: "stack"}}
+	vars, err := expressionVars(ar, record.submitted(tf, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for expression, want := range map[string]bool{
+		`request.operation == "UPDATE"`:                                         true,
+		`object.spec.taskOptions.exists(o, "plan" in o.for)`:                    true,
+		`object.spec.taskOptions.exists(o, "apply" in o.for)`:                   false,
+		`size(object.spec.taskOptions) == 1 && object.metadata.name == "stack"`: true,
+	} {
+		opt := mustParsePluginOption(t, "monitor", fmt.Sprintf(`{"expression": %q}`, expression))
+		got, err := opt.evaluate(vars)
+		if err != nil {
+			t.Errorf("evaluate(%s) error = %s", expression, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("evaluate(%s) = %v, want %v", expression, got, want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	jsonpatchapply "github.com/evanphx/json-patch"
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	"github.com/mattbaird/jsonpatch"
+)
+
+// DefaultProtectedPaths are the Terraform fields plugin patches must not change. Paths are JSON
+// pointers whose segments are matched with path.Match, a change below a protected path is also denied.
+var DefaultProtectedPaths = []string{
+	"/apiVersion",
+	"/kind",
+	"/metadata/name",
+	"/metadata/generateName",
+	"/metadata/namespace",
+	"/metadata/uid",
+	"/metadata/resourceVersion",
+	"/metadata/generation",
+	"/metadata/creationTimestamp",
+	"/metadata/deletionTimestamp",
+	"/metadata/deletionGracePeriodSeconds",
+	"/metadata/finalizers",
+	"/metadata/ownerReferences",
+	"/metadata/managedFields",
+	"/status",
+	"/spec/serviceAccount",
+	"/spec/taskOptions/*/policyRules",
+	// The record of what the manager injected, see injectedAnnotation
+	"/metadata/annotations/plugin-manager.galleybytes.com~1injected",
+}
+
+// decodeFragments checks that the plugin's patches are well formed, so mistakes are reported when the
+// plugin is loaded, and decodes the JSON patch.
+//
+// The patches are applied on every admission of a Terraform, including each update of a Terraform they
+// were applied to before, so they must be idempotent. Merge patches always are. JSON patch operations
+// that insert into or remove from arrays (`add` or `remove` at `/-` or an index), `move` and `copy`
+// are not and are rejected. A `remove` or `replace` of a path that does not exist does nothing, so a
+// patch still applies once it removed what it removes.
+func (opt *pluginOption) decodeFragments() error {
+	if len(opt.MergePatch) > 0 {
+		var patch map[string]interface{}
+		if err := json.Unmarshal(opt.MergePatch, &patch); err != nil {
+			return fmt.Errorf("mergePatch must be a JSON object: %s", err)
+		}
+	}
+	if len(opt.JSONPatch) > 0 {
+		patch, err := jsonpatchapply.DecodePatch(opt.JSONPatch)
+		if err != nil {
+			return fmt.Errorf("invalid jsonPatch: %s", err)
+		}
+		for i, op := range patch {
+			pointer, err := op.Path()
+			if err != nil {
+				return fmt.Errorf("invalid jsonPatch: operation %d: %s", i, err)
+			}
+			if err := idempotentOperation(op.Kind(), pointer); err != nil {
+				return fmt.Errorf("invalid jsonPatch: operation %d: %s", i, err)
+			}
+		}
+		opt.jsonPatch = patch
+	}
+	return nil
+}
+
+// idempotentOperation returns why applying the JSON patch operation again would change the result. The
+// last segment of an `add` or `remove` is taken to be an array index when it is numeric.
+func idempotentOperation(kind, pointer string) error {
+	switch kind {
+	case "move", "copy":
+		return fmt.Errorf("'%s' is not idempotent", kind)
+	case "add", "remove":
+		segments := pointerSegments(pointer)
+		if len(segments) == 0 {
+			return nil
+		}
+		last := segments[len(segments)-1]
+		if _, err := strconv.Atoi(last); last != "-" && err != nil {
+			return nil
+		}
+		if kind == "add" {
+			return fmt.Errorf("'add' to '%s' inserts into an array which is not idempotent, use 'replace' or a mergePatch", pointer)
+		}
+		return fmt.Errorf("'remove' of '%s' removes from an array which is not idempotent, use 'replace' or a mergePatch", pointer)
+	}
+	return nil
+}
+
+// applyFragments applies the plugin's merge patch and then its JSON patch to the Terraform. Nothing is
+// changed when a patch fails or changes a protected path.
+func (opt pluginOption) applyFragments(tf *tfv1beta1.Terraform, protectedPaths []string) (*tfv1beta1.Terraform, error) {
+	if len(opt.MergePatch) == 0 && opt.jsonPatch == nil {
+		return tf, nil
+	}
+	original, err := json.Marshal(tf)
+	if err != nil {
+		return nil, err
+	}
+	patched := original
+	if len(opt.MergePatch) > 0 {
+		patched, err = jsonpatchapply.MergePatch(patched, opt.MergePatch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply mergePatch: %s", err)
+		}
+	}
+	if opt.jsonPatch != nil {
+		patched, err = applyJSONPatch(opt.jsonPatch, patched)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply jsonPatch: %s", err)
+		}
+	}
+
+	// The changes are diffed so both kinds of patches are checked the same way
+	changes, err := jsonpatch.CreatePatch(original, patched)
+	if err != nil {
+		return nil, err
+	}
+	var before interface{}
+	if err := json.Unmarshal(original, &before); err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if protected := protectedPath(change, before, protectedPaths); protected != "" {
+			return nil, fmt.Errorf("patch changes '%s' which is protected by '%s'", change.Path, protected)
+		}
+	}
+	return decodeTerraform(patched)
+}
+
+// applyJSONPatch applies the operations in order. An operation that removes or replaces a path that does
+// not exist is skipped.
+func applyJSONPatch(patch jsonpatchapply.Patch, doc []byte) ([]byte, error) {
+	for i, op := range patch {
+		if kind := op.Kind(); kind == "remove" || kind == "replace" {
+			pointer, err := op.Path()
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %s", i, err)
+			}
+			var current interface{}
+			if err := json.Unmarshal(doc, &current); err != nil {
+				return nil, err
+			}
+			if !pointerExists(current, pointerSegments(pointer)) {
+				continue
+			}
+		}
+		patched, err := jsonpatchapply.Patch{op}.Apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+		doc = patched
+	}
+	return doc, nil
+}
+
+// protectedPath returns the protected path the change touches or an empty string. Changes above a
+// protected path only touch it when the protected path exists in the old or new value.
+func protectedPath(change jsonpatch.JsonPatchOperation, before interface{}, protectedPaths []string) string {
+	segments := pointerSegments(change.Path)
+	for _, protected := range protectedPaths {
+		protectedSegments := pointerSegments(protected)
+		n := len(segments)
+		if n > len(protectedSegments) {
+			n = len(protectedSegments)
+		}
+		if !segmentsMatch(protectedSegments[:n], segments[:n]) {
+			continue
+		}
+		if len(segments) >= len(protectedSegments) {
+			return protected
+		}
+		below := protectedSegments[len(segments):]
+		if change.Operation != "remove" && exists(change.Value, below) {
+			return protected
+		}
+		if change.Operation != "add" && exists(lookup(before, segments), below) {
+			return protected
+		}
+	}
+	return ""
+}
+
+func pointerSegments(pointer string) []string {
+	if pointer == "" {
+		return []string{}
+	}
+	segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+	}
+	return segments
+}
+
+// pointerExists checks if the value has the unescaped pointer segments, including a null value
+func pointerExists(value interface{}, segments []string) bool {
+	for _, segment := range segments {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, found := v[segment]
+			if !found {
+				return false
+			}
+			value = child
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return false
+			}
+			value = v[i]
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func segmentsMatch(patterns, segments []string) bool {
+	for i, pattern := range patterns {
+		if ok, _ := path.Match(pattern, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// exists checks if anything in the value matches the pattern segments
+func exists(value interface{}, patterns []string) bool {
+	if len(patterns) == 0 {
+		return value != nil
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if ok, _ := path.Match(patterns[0], key); ok && exists(child, patterns[1:]) {
+				return true
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if ok, _ := path.Match(patterns[0], strconv.Itoa(i)); ok && exists(child, patterns[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
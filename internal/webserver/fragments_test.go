@@ -0,0 +1,214 @@
+package webserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	"github.com/mattbaird/jsonpatch"
+)
+
+func TestDecodeFragments(t *testing.T) {
+	tests := []struct {
+		name       string
+		definition string
+		wantErr    string
+	}{
+		{
+			name:       "merge patch",
+			definition: `{"mergePatch": {"metadata": {"labels": {"team": "platform"}}}}`,
+		},
+		{
+			name:       "merge patch that is not an object",
+			definition: `{"mergePatch": ["metadata"]}`,
+			wantErr:    "mergePatch must be a JSON object: json: cannot unmarshal array into Go value of type map[string]interface {}",
+		},
+		{
+			name:       "idempotent operations",
+			definition: `{"jsonPatch": [{"op": "add", "path": "/metadata/labels/team", "value": "platform"}, {"op": "replace", "path": "/spec/terraformVersion", "value": "1.5.2"}, {"op": "remove", "path": "/metadata/labels/old"}, {"op": "test", "path": "/kind", "value": "Terraform"}]}`,
+		},
+		{
+			name:       "append to an array",
+			definition: `{"jsonPatch": [{"op": "add", "path": "/spec/taskOptions/-", "value": {}}]}`,
+			wantErr:    "invalid jsonPatch: operation 0: 'add' to '/spec/taskOptions/-' inserts into an array which is not idempotent, use 'replace' or a mergePatch",
+		},
+		{
+			name:       "insert into an array",
+			definition: `{"jsonPatch": [{"op": "add", "path": "/spec/taskOptions/0/env/0", "value": {}}]}`,
+			wantErr:    "invalid jsonPatch: operation 0: 'add' to '/spec/taskOptions/0/env/0' inserts into an array which is not idempotent, use 'replace' or a mergePatch",
+		},
+		{
+			name:       "remove from an array",
+			definition: `{"jsonPatch": [{"op": "remove", "path": "/spec/taskOptions/0"}]}`,
+			wantErr:    "invalid jsonPatch: operation 0: 'remove' of '/spec/taskOptions/0' removes from an array which is not idempotent, use 'replace' or a mergePatch",
+		},
+		{
+			name:       "move",
+			definition: `{"jsonPatch": [{"op": "replace", "path": "/spec/terraformVersion", "value": "1.5.2"}, {"op": "move", "from": "/metadata/labels/a", "path": "/metadata/labels/b"}]}`,
+			wantErr:    "invalid jsonPatch: operation 1: 'move' is not idempotent",
+		},
+		{
+			name:       "copy",
+			definition: `{"jsonPatch": [{"op": "copy", "from": "/metadata/labels/a", "path": "/metadata/labels/b"}]}`,
+			wantErr:    "invalid jsonPatch: operation 0: 'copy' is not idempotent",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePluginOption([]byte(tt.definition))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("error = %s, want none", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyFragmentsIsIdempotent(t *testing.T) {
+	opt := mustParsePluginOption(t, "labels", `{
+		"mergePatch": {"metadata": {"annotations": {"owner": "platform"}}},
+		"jsonPatch": [
+			{"op": "add", "path": "/metadata/labels/team", "value": "platform"},
+			{"op": "remove", "path": "/metadata/labels/old"},
+			{"op": "replace", "path": "/metadata/annotations/missing", "value": "never"}
+		]
+	}`)
+	if opt.jsonPatch == nil {
+		t.Fatal("jsonPatch was not decoded when the plugin was parsed")
+	}
+	tf := &tfv1beta1.Terraform{}
+	tf.Name = "stack"
+	tf.Labels = map[string]string{"old": "stack"}
+	once, err := opt.applyFragments(tf, DefaultProtectedPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := opt.applyFragments(once.DeepCopy(), DefaultProtectedPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Removing and replacing what does not exist does nothing
+	if !reflect.DeepEqual(once.Labels, map[string]string{"team": "platform"}) || !reflect.DeepEqual(once.Annotations, map[string]string{"owner": "platform"}) {
+		t.Errorf("patches were not applied: labels %v annotations %v", once.Labels, once.Annotations)
+	}
+	if !reflect.DeepEqual(once, twice) {
+		t.Errorf("applying the patches again changed the Terraform: %+v, want %+v", twice.ObjectMeta, once.ObjectMeta)
+	}
+
+	for _, patch := range []string{
+		`{"jsonPatch": [{"op": "replace", "path": "/metadata/name", "value": "other"}]}`,
+		`{"jsonPatch": [{"op": "add", "path": "/metadata/annotations/plugin-manager.galleybytes.com~1injected", "value": "{}"}]}`,
+	} {
+		protected := mustParsePluginOption(t, "protected", patch)
+		if _, err := protected.applyFragments(once, DefaultProtectedPaths); err == nil {
+			t.Errorf("patch %s changed a protected path", patch)
+		}
+	}
+}
+
+func TestProtectedPath(t *testing.T) {
+	var before interface{}
+	if err := json.Unmarshal([]byte(`{
+		"metadata": {"name": "stack", "labels": {"team": "a"}},
+		"spec": {"taskOptions": [{"for": ["plan"], "policyRules": [{"verbs": ["get"]}]}, {"for": ["apply"]}]}
+	}`), &before); err != nil {
+		t.Fatal(err)
+	}
+	protectedPaths := []string{"/metadata/name", "/spec/taskOptions/*/policyRules", "/status"}
+	tests := []struct {
+		name   string
+		change jsonpatch.JsonPatchOperation
+		want   string
+	}{
+		{
+			name:   "unprotected path",
+			change: jsonpatch.JsonPatchOperation{Operation: "add", Path: "/metadata/labels/owner", Value: "b"},
+		},
+		{
+			name:   "protected path",
+			change: jsonpatch.JsonPatchOperation{Operation: "replace", Path: "/metadata/name", Value: "other"},
+			want:   "/metadata/name",
+		},
+		{
+			name:   "below a protected path",
+			change: jsonpatch.JsonPatchOperation{Operation: "add", Path: "/status/phase", Value: "done"},
+			want:   "/status",
+		},
+		{
+			name:   "protected path matched by a pattern",
+			change: jsonpatch.JsonPatchOperation{Operation: "replace", Path: "/spec/taskOptions/0/policyRules/0/verbs/0", Value: "*"},
+			want:   "/spec/taskOptions/*/policyRules",
+		},
+		{
+			name:   "sibling of a protected path",
+			change: jsonpatch.JsonPatchOperation{Operation: "replace", Path: "/spec/taskOptions/0/for/0", Value: "apply"},
+		},
+		{
+			name:   "above a protected path that the value does not set",
+			change: jsonpatch.JsonPatchOperation{Operation: "add", Path: "/spec/taskOptions/2", Value: map[string]interface{}{"for": []interface{}{"init"}}},
+		},
+		{
+			name: "above a protected path that the value sets",
+			change: jsonpatch.JsonPatchOperation{Operation: "add", Path: "/spec/taskOptions/2", Value: map[string]interface{}{
+				"for": []interface{}{"init"}, "policyRules": []interface{}{map[string]interface{}{"verbs": []interface{}{"*"}}},
+			}},
+			want: "/spec/taskOptions/*/policyRules",
+		},
+		{
+			name:   "removing above a protected path that exists",
+			change: jsonpatch.JsonPatchOperation{Operation: "remove", Path: "/spec/taskOptions/0"},
+			want:   "/spec/taskOptions/*/policyRules",
+		},
+		{
+			name:   "removing above a protected path that does not exist",
+			change: jsonpatch.JsonPatchOperation{Operation: "remove", Path: "/spec/taskOptions/1"},
+		},
+		{
+			name:   "replacing the parent of protected paths",
+			change: jsonpatch.JsonPatchOperation{Operation: "replace", Path: "/metadata", Value: map[string]interface{}{"name": "stack"}},
+			want:   "/metadata/name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := protectedPath(tt.change, before, protectedPaths); got != tt.want {
+				t.Errorf("protectedPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExists(t *testing.T) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(`{"taskOptions": [{"env": [{"name": "A"}]}, {"labels": {"team": null}}]}`), &value); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		patterns []string
+		want     bool
+	}{
+		{patterns: []string{}, want: true},
+		{patterns: []string{"taskOptions"}, want: true},
+		{patterns: []string{"taskOptions", "0", "env"}, want: true},
+		{patterns: []string{"taskOptions", "*", "env", "*", "name"}, want: true},
+		{patterns: []string{"taskOptions", "1", "env"}, want: false},
+		{patterns: []string{"taskOptions", "2"}, want: false},
+		{patterns: []string{"taskOptions", "*", "labels", "team"}, want: false},
+		{patterns: []string{"taskOptions", "0", "env", "0", "name", "deeper"}, want: false},
+		{patterns: []string{"missing"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := exists(value, tt.patterns); got != tt.want {
+			t.Errorf("exists(%q) = %v, want %v", tt.patterns, got, tt.want)
+		}
+	}
+	if exists(nil, []string{}) {
+		t.Error("nil exists")
+	}
+}
@@ -0,0 +1,128 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// LatestPolicy is what happens to images that are not pinned to a digest and use the latest tag,
+// explicitly or by leaving out the tag
+type LatestPolicy string
+
+const (
+	LatestAllow  LatestPolicy = "allow"
+	LatestWarn   LatestPolicy = "warn"
+	LatestReject LatestPolicy = "reject"
+)
+
+// ImagePolicy restricts the images of plugins. It is applied when the plugins are loaded and to the
+// images Terraforms override.
+type ImagePolicy struct {
+	// AllowedRegistries are the registries, or registry paths, images must come from. Images without a
+	// registry are from docker.io. Any image is allowed when it is empty.
+	AllowedRegistries []string `json:"allowedRegistries"`
+	// RequireDigest rejects images that are not pinned to a digest, either in the image or by Digests
+	RequireDigest bool `json:"requireDigest"`
+	// Digests pins images to a digest, eg `"busybox:1.36": "sha256:..."`. Images are looked up as
+	// written and in their fully qualified form.
+	Digests map[string]string `json:"digests"`
+	// Latest is allow, warn or reject
+	Latest LatestPolicy `json:"latest"`
+}
+
+// DefaultImagePolicy allows every image and warns about the latest tag
+func DefaultImagePolicy() ImagePolicy {
+	return ImagePolicy{Latest: LatestWarn}
+}
+
+// LoadImagePolicy reads the policy from a JSON file. Unset fields keep the default policy's values.
+func LoadImagePolicy(filename string) (ImagePolicy, error) {
+	policy := DefaultImagePolicy()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return policy, fmt.Errorf("failed to read image policy '%s': %s", filename, err)
+	}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse image policy '%s': %s", filename, err)
+	}
+	switch policy.Latest {
+	case LatestAllow, LatestWarn, LatestReject:
+	default:
+		return policy, fmt.Errorf("image policy '%s' has unknown latest policy '%s'", filename, policy.Latest)
+	}
+	return policy, nil
+}
+
+// imageRef is an image split into its parts
+type imageRef struct {
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseImage(image string) imageRef {
+	var ref imageRef
+	ref.repository, ref.digest, _ = strings.Cut(image, "@")
+	// A colon after the last slash separates the tag, others are part of the registry's host:port
+	if i := strings.LastIndex(ref.repository, ":"); i > strings.LastIndex(ref.repository, "/") {
+		ref.tag = ref.repository[i+1:]
+		ref.repository = ref.repository[:i]
+	}
+	return ref
+}
+
+// qualified returns the repository with the registry docker uses when it is left out
+func (r imageRef) qualified() string {
+	first, rest, found := strings.Cut(r.repository, "/")
+	if !found {
+		return "docker.io/library/" + r.repository
+	}
+	if !strings.ContainsAny(first, ".:") && first != "localhost" {
+		return "docker.io/" + first + "/" + rest
+	}
+	return r.repository
+}
+
+// resolve checks the image against the policy and returns it pinned to a digest when the policy maps it
+// to one. The warnings describe what the policy allows but does not recommend.
+func (p ImagePolicy) resolve(image string) (string, []string, error) {
+	if image == "" {
+		return image, nil, nil
+	}
+	ref := parseImage(image)
+	if !imageFromRegistries(image, p.AllowedRegistries) {
+		return "", nil, fmt.Errorf("image '%s' is not from an allowed registry", image)
+	}
+
+	if ref.digest == "" {
+		tag := ref.tag
+		if tag == "" {
+			tag = "latest"
+		}
+		for _, key := range []string{image, ref.qualified() + ":" + tag} {
+			if digest, ok := p.Digests[key]; ok {
+				ref.digest = digest
+				image = image + "@" + digest
+				break
+			}
+		}
+	}
+	if ref.digest != "" {
+		return image, nil, nil
+	}
+
+	if p.RequireDigest {
+		return "", nil, fmt.Errorf("image '%s' is not pinned to a digest", image)
+	}
+	if ref.tag == "" || ref.tag == "latest" {
+		switch p.Latest {
+		case LatestReject:
+			return "", nil, fmt.Errorf("image '%s' uses the latest tag", image)
+		case LatestWarn:
+			return image, []string{fmt.Sprintf("image '%s' uses the latest tag, pin it to a version or digest", image)}, nil
+		}
+	}
+	return image, nil, nil
+}
@@ -0,0 +1,233 @@
+package webserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image         string
+		want          imageRef
+		wantQualified string
+	}{
+		{
+			image:         "busybox",
+			want:          imageRef{repository: "busybox"},
+			wantQualified: "docker.io/library/busybox",
+		},
+		{
+			image:         "busybox:1.36",
+			want:          imageRef{repository: "busybox", tag: "1.36"},
+			wantQualified: "docker.io/library/busybox",
+		},
+		{
+			image:         "galleybytes/monitor:0.1.3",
+			want:          imageRef{repository: "galleybytes/monitor", tag: "0.1.3"},
+			wantQualified: "docker.io/galleybytes/monitor",
+		},
+		{
+			image:         "ghcr.io/galleybytes/monitor:0.1.3",
+			want:          imageRef{repository: "ghcr.io/galleybytes/monitor", tag: "0.1.3"},
+			wantQualified: "ghcr.io/galleybytes/monitor",
+		},
+		{
+			image:         "registry.local:5000/monitor",
+			want:          imageRef{repository: "registry.local:5000/monitor"},
+			wantQualified: "registry.local:5000/monitor",
+		},
+		{
+			image:         "registry.local:5000/team/monitor:0.1.3",
+			want:          imageRef{repository: "registry.local:5000/team/monitor", tag: "0.1.3"},
+			wantQualified: "registry.local:5000/team/monitor",
+		},
+		{
+			image:         "localhost/monitor:0.1.3",
+			want:          imageRef{repository: "localhost/monitor", tag: "0.1.3"},
+			wantQualified: "localhost/monitor",
+		},
+		{
+			image:         "localhost:5000/monitor",
+			want:          imageRef{repository: "localhost:5000/monitor"},
+			wantQualified: "localhost:5000/monitor",
+		},
+		{
+			image:         "monitor@sha256:abc",
+			want:          imageRef{repository: "monitor", digest: "sha256:abc"},
+			wantQualified: "docker.io/library/monitor",
+		},
+		{
+			image:         "registry.local:5000/monitor:0.1.3@sha256:abc",
+			want:          imageRef{repository: "registry.local:5000/monitor", tag: "0.1.3", digest: "sha256:abc"},
+			wantQualified: "registry.local:5000/monitor",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref := parseImage(tt.image)
+			if ref != tt.want {
+				t.Errorf("parseImage() = %+v, want %+v", ref, tt.want)
+			}
+			if qualified := ref.qualified(); qualified != tt.wantQualified {
+				t.Errorf("qualified() = %s, want %s", qualified, tt.wantQualified)
+			}
+		})
+	}
+}
+
+func TestImagePolicyResolve(t *testing.T) {
+	digests := map[string]string{
+		"busybox:1.36":                        "sha256:written",
+		"docker.io/library/alpine:3.18":       "sha256:qualified",
+		"docker.io/library/ubuntu:latest":     "sha256:latest",
+		"registry.local:5000/monitor:0.1.3":   "sha256:port",
+		"docker.io/galleybytes/monitor:0.1.3": "sha256:user",
+	}
+	tests := []struct {
+		name         string
+		policy       ImagePolicy
+		image        string
+		want         string
+		wantWarnings []string
+		wantErr      string
+	}{
+		{
+			name:   "no image",
+			policy: ImagePolicy{RequireDigest: true},
+			image:  "",
+			want:   "",
+		},
+		{
+			name:   "tagged",
+			policy: DefaultImagePolicy(),
+			image:  "busybox:1.36",
+			want:   "busybox:1.36",
+		},
+		{
+			name:         "no tag warns",
+			policy:       DefaultImagePolicy(),
+			image:        "busybox",
+			want:         "busybox",
+			wantWarnings: []string{"image 'busybox' uses the latest tag, pin it to a version or digest"},
+		},
+		{
+			name:         "latest tag warns",
+			policy:       DefaultImagePolicy(),
+			image:        "registry.local:5000/monitor:latest",
+			want:         "registry.local:5000/monitor:latest",
+			wantWarnings: []string{"image 'registry.local:5000/monitor:latest' uses the latest tag, pin it to a version or digest"},
+		},
+		{
+			name:   "port is not a tag",
+			policy: ImagePolicy{Latest: LatestReject},
+			image:  "registry.local:5000/monitor:0.1.3",
+			want:   "registry.local:5000/monitor:0.1.3",
+		},
+		{
+			name:    "port without a tag is latest",
+			policy:  ImagePolicy{Latest: LatestReject},
+			image:   "registry.local:5000/monitor",
+			wantErr: "image 'registry.local:5000/monitor' uses the latest tag",
+		},
+		{
+			name:   "latest allowed",
+			policy: ImagePolicy{Latest: LatestAllow},
+			image:  "busybox:latest",
+			want:   "busybox:latest",
+		},
+		{
+			name:   "latest pinned to a digest",
+			policy: ImagePolicy{Latest: LatestReject, Digests: digests},
+			image:  "ubuntu",
+			want:   "ubuntu@sha256:latest",
+		},
+		{
+			name:   "digest looked up as written",
+			policy: ImagePolicy{Digests: digests},
+			image:  "busybox:1.36",
+			want:   "busybox:1.36@sha256:written",
+		},
+		{
+			name:   "digest looked up qualified",
+			policy: ImagePolicy{Digests: digests},
+			image:  "alpine:3.18",
+			want:   "alpine:3.18@sha256:qualified",
+		},
+		{
+			name:   "digest of a user repository looked up qualified",
+			policy: ImagePolicy{Digests: digests},
+			image:  "galleybytes/monitor:0.1.3",
+			want:   "galleybytes/monitor:0.1.3@sha256:user",
+		},
+		{
+			name:   "digest of a registry with a port",
+			policy: ImagePolicy{RequireDigest: true, Digests: digests},
+			image:  "registry.local:5000/monitor:0.1.3",
+			want:   "registry.local:5000/monitor:0.1.3@sha256:port",
+		},
+		{
+			name:   "image with a digest is kept",
+			policy: ImagePolicy{RequireDigest: true, Latest: LatestReject, Digests: digests},
+			image:  "busybox@sha256:own",
+			want:   "busybox@sha256:own",
+		},
+		{
+			name:    "digest required",
+			policy:  ImagePolicy{RequireDigest: true, Digests: digests},
+			image:   "busybox:1.35",
+			wantErr: "image 'busybox:1.35' is not pinned to a digest",
+		},
+		{
+			name:   "allowed registry",
+			policy: ImagePolicy{AllowedRegistries: []string{"ghcr.io/galleybytes/"}},
+			image:  "ghcr.io/galleybytes/monitor:0.1.3",
+			want:   "ghcr.io/galleybytes/monitor:0.1.3",
+		},
+		{
+			name:   "docker.io registry",
+			policy: ImagePolicy{AllowedRegistries: []string{"docker.io/library"}},
+			image:  "busybox:1.36",
+			want:   "busybox:1.36",
+		},
+		{
+			name:   "localhost registry",
+			policy: ImagePolicy{AllowedRegistries: []string{"localhost:5000"}},
+			image:  "localhost:5000/monitor:0.1.3",
+			want:   "localhost:5000/monitor:0.1.3",
+		},
+		{
+			name:    "registry path is not a prefix of the name",
+			policy:  ImagePolicy{AllowedRegistries: []string{"ghcr.io/galleybytes"}},
+			image:   "ghcr.io/galleybytes-fork/monitor:0.1.3",
+			wantErr: "image 'ghcr.io/galleybytes-fork/monitor:0.1.3' is not from an allowed registry",
+		},
+		{
+			name:    "docker.io image when only other registries are allowed",
+			policy:  ImagePolicy{AllowedRegistries: []string{"ghcr.io"}},
+			image:   "monitor:0.1.3",
+			wantErr: "image 'monitor:0.1.3' is not from an allowed registry",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, warnings, err := tt.policy.resolve(tt.image)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image != tt.want {
+				t.Errorf("image = %s, want %s", image, tt.want)
+			}
+			if len(warnings) > 0 || len(tt.wantWarnings) > 0 {
+				if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+					t.Errorf("warnings = %q, want %q", warnings, tt.wantWarnings)
+				}
+			}
+		})
+	}
+}
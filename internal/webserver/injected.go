@@ -0,0 +1,194 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+)
+
+// injectedAnnotation records on the Terraform what the manager injected so later admissions can tell it
+// apart from what the user defined
+const injectedAnnotation = overrideAnnotationPrefix + "injected"
+
+// injectedRecord is the value of the injectedAnnotation
+type injectedRecord struct {
+	// Plugins maps the injected plugins to the hash of the plugin as it was injected
+	Plugins map[tfv1beta1.TaskName]string `json:"plugins,omitempty"`
+	// TaskOptions are the task options the manager added for extra task configs
+	TaskOptions []injectedTaskOption `json:"taskOptions,omitempty"`
+	// Overrides maps the injected plugins to the fields their override annotations changed
+	Overrides map[tfv1beta1.TaskName][]string `json:"overrides,omitempty"`
+}
+
+// injectedTaskOption identifies a task option the manager added by its index and the hash of the task
+// option as it was injected. A task option the user changed since is the user's.
+type injectedTaskOption struct {
+	Index int    `json:"index"`
+	Hash  string `json:"hash"`
+}
+
+// readInjectedRecord returns what the manager injected into the Terraform. A record that can not be
+// read is treated as empty, which at worst reports a conflict for a plugin the manager injected.
+func readInjectedRecord(tf *tfv1beta1.Terraform) injectedRecord {
+	record := injectedRecord{}
+	if value, found := tf.ObjectMeta.Annotations[injectedAnnotation]; found {
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			logger.V(1).Info("Ignoring the record of injected plugins", "error", err.Error())
+		}
+	}
+	if record.Plugins == nil {
+		record.Plugins = map[tfv1beta1.TaskName]string{}
+	}
+	return record
+}
+
+// owns checks if the manager injected the Terraform's plugin and it was not changed since
+func (r injectedRecord) owns(tf *tfv1beta1.Terraform, name tfv1beta1.TaskName) bool {
+	plugin, found := tf.Spec.Plugins[name]
+	return found && r.Plugins[name] != "" && r.Plugins[name] == pluginHash(plugin)
+}
+
+// update records the applied plugins as they are in the Terraform, the fields their overrides changed and
+// the task options the manager owns, see ownedTaskOptions. Plugins that were removed from the Terraform
+// are forgotten.
+func (r *injectedRecord) update(tf *tfv1beta1.Terraform, applied []*pluginOption, taskOptions map[int]bool) {
+	for name := range r.Plugins {
+		if _, found := tf.Spec.Plugins[name]; !found {
+			delete(r.Plugins, name)
+		}
+	}
+	for name := range r.Overrides {
+		if _, found := tf.Spec.Plugins[name]; !found {
+			delete(r.Overrides, name)
+		}
+	}
+	for _, opt := range applied {
+		plugin, found := tf.Spec.Plugins[opt.name]
+		if !found {
+			continue
+		}
+		r.Plugins[opt.name] = pluginHash(plugin)
+		if len(opt.overridden) == 0 {
+			delete(r.Overrides, opt.name)
+			continue
+		}
+		if r.Overrides == nil {
+			r.Overrides = map[tfv1beta1.TaskName][]string{}
+		}
+		r.Overrides[opt.name] = opt.overridden
+	}
+
+	r.TaskOptions = []injectedTaskOption{}
+	for i, taskOption := range tf.Spec.TaskOptions {
+		if taskOptions[i] {
+			r.TaskOptions = append(r.TaskOptions, injectedTaskOption{Index: i, Hash: taskOptionHash(taskOption)})
+		}
+	}
+}
+
+// staleOverrides returns the fields an earlier admission overrode for the plugin that it no longer
+// overrides, ie whose override annotations were removed or denied since. Fields the plugin sets itself
+// are not stale, merging the plugin's task option restores them in place.
+func (r injectedRecord) staleOverrides(opt *pluginOption) map[string]bool {
+	overridden := map[string]bool{}
+	for _, field := range opt.overridden {
+		overridden[field] = true
+	}
+	stale := map[string]bool{}
+	for _, field := range r.Overrides[opt.name] {
+		if overridden[field] {
+			continue
+		}
+		kind, name, _ := strings.Cut(field, ".")
+		_, label := opt.TaskOption.Labels[name]
+		_, annotation := opt.TaskOption.Annotations[name]
+		if (kind == "env" && hasEnv(opt.TaskOption, name)) || (kind == "labels" && label) || (kind == "annotations" && annotation) {
+			continue
+		}
+		stale[field] = true
+	}
+	return stale
+}
+
+// ownedTaskOptions returns the indexes of the Terraform's task options the manager added for extra task
+// configs and that were not changed since. A recorded task option is looked for at its index first and
+// then, in case the task options before it were removed, anywhere else. Each task option is only owned
+// once, so a copy the user made of an injected task option stays the user's.
+func (r injectedRecord) ownedTaskOptions(tf *tfv1beta1.Terraform) map[int]bool {
+	hashes := make([]string, len(tf.Spec.TaskOptions))
+	for i, taskOption := range tf.Spec.TaskOptions {
+		hashes[i] = taskOptionHash(taskOption)
+	}
+	owned := map[int]bool{}
+	for _, recorded := range r.TaskOptions {
+		if recorded.Index >= 0 && recorded.Index < len(hashes) && !owned[recorded.Index] && hashes[recorded.Index] == recorded.Hash {
+			owned[recorded.Index] = true
+			continue
+		}
+		for i, hash := range hashes {
+			if !owned[i] && hash == recorded.Hash {
+				owned[i] = true
+				break
+			}
+		}
+	}
+	return owned
+}
+
+// submitted returns a copy of the Terraform without the task options the manager injected: the task
+// options of the plugins, which are only for the plugin, and the ones recorded for extra task configs.
+// Plugin conditions are matched against it so they neither depend on the plugins applied before them
+// nor on what earlier admissions injected.
+func (r injectedRecord) submitted(tf *tfv1beta1.Terraform, opts []*pluginOption) *tfv1beta1.Terraform {
+	plugins := map[tfv1beta1.TaskName]bool{}
+	for name := range r.Plugins {
+		plugins[name] = true
+	}
+	for _, opt := range opts {
+		plugins[opt.name] = true
+	}
+	owned := r.ownedTaskOptions(tf)
+	submitted := tf.DeepCopy()
+	taskOptions := []tfv1beta1.TaskOption{}
+	for i, taskOption := range submitted.Spec.TaskOptions {
+		if len(taskOption.For) == 1 && plugins[taskOption.For[0]] {
+			continue
+		}
+		if owned[i] {
+			continue
+		}
+		taskOptions = append(taskOptions, taskOption)
+	}
+	submitted.Spec.TaskOptions = taskOptions
+	return submitted
+}
+
+// write sets the record on the Terraform, or removes it when nothing is recorded
+func (r injectedRecord) write(tf *tfv1beta1.Terraform) error {
+	if len(r.Plugins) == 0 && len(r.TaskOptions) == 0 && len(r.Overrides) == 0 {
+		delete(tf.ObjectMeta.Annotations, injectedAnnotation)
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if tf.ObjectMeta.Annotations == nil {
+		tf.ObjectMeta.Annotations = map[string]string{}
+	}
+	tf.ObjectMeta.Annotations[injectedAnnotation] = string(b)
+	return nil
+}
+
+func pluginHash(plugin tfv1beta1.Plugin) string {
+	b, _ := json.Marshal(plugin)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+func taskOptionHash(taskOption tfv1beta1.TaskOption) string {
+	b, _ := json.Marshal(taskOption)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
@@ -0,0 +1,36 @@
+package webserver
+
+import (
+	"expvar"
+	"fmt"
+)
+
+// Metrics are published with expvar and served on /debug/vars of Config.MetricsAddr
+var (
+	// pluginConflicts counts conflicts by where they were found and the policy that resolved them
+	pluginConflicts = expvar.NewMap("plugin_conflicts_total")
+	// pluginLoads counts loads of the plugin directory by whether the plugins were valid
+	pluginLoads = expvar.NewMap("plugin_loads_total")
+	// terraformEventResults counts the events of mutated Terraforms by whether they were recorded, timed out
+	// waiting for the Terraform or dropped because too many were queued
+	terraformEventResults = expvar.NewMap("terraform_events_total")
+	// auditRecords counts audit records by whether they were written, failed to be written or dropped
+	// because the audit buffer was full
+	auditRecords = expvar.NewMap("audit_records_total")
+)
+
+func countPluginConflict(stage string, policy ConflictPolicy) {
+	pluginConflicts.Add(fmt.Sprintf("%s:%s", stage, policy), 1)
+}
+
+func countPluginLoad(result string) {
+	pluginLoads.Add(result, 1)
+}
+
+func countTerraformEvent(result string) {
+	terraformEventResults.Add(result, 1)
+}
+
+func countAuditRecord(result string) {
+	auditRecords.Add(result, 1)
+}
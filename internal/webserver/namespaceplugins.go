@@ -0,0 +1,265 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NamespacePluginsLabel marks, with the value `true`, the ConfigMaps that define plugins for their
+// namespace. Every key of a marked ConfigMap is a plugin definition named after the key.
+const NamespacePluginsLabel = "plugin-manager.galleybytes.com/plugin-definitions"
+
+// NamespacePluginPolicy is the cluster's policy for plugins defined in namespaces. Namespace plugins are
+// applied after the cluster's plugins and never replace one: a namespace plugin that conflicts with a
+// cluster plugin, or that can not be ordered, is ignored on its own.
+type NamespacePluginPolicy struct {
+	// AllowedFields are the plugin definition fields namespace plugins may set. Fields are dotted paths,
+	// eg `taskConfig.env`, matched with path.Match. A field is also allowed when its parent is.
+	AllowedFields []string `json:"allowedFields"`
+	// AllowedRegistries are the registries, or registry paths, namespace plugin images must come from.
+	// No namespace plugin is allowed when it is empty.
+	AllowedRegistries []string `json:"allowedRegistries"`
+}
+
+// DefaultNamespacePluginPolicy lets namespace plugins set their own image, env, labels, annotations and
+// resources but not grant themselves permissions or order themselves by priority. It allows no
+// registries, so namespaces can not define plugins until a policy lists the registries they may use.
+func DefaultNamespacePluginPolicy() NamespacePluginPolicy {
+	return NamespacePluginPolicy{
+		AllowedFields: []string{
+			"skipAnnotation",
+			"overrides",
+			"dependsOn",
+			"secretEnv",
+			"namespaceOptIn",
+			"conditions",
+			"expression",
+			"pluginConfig.image",
+			"pluginConfig.imagePullPolicy",
+			"pluginConfig.when",
+			"pluginConfig.task",
+			"taskConfig.env",
+			"taskConfig.envFrom",
+			"taskConfig.labels",
+			"taskConfig.annotations",
+			"taskConfig.resources",
+			"taskConfig.restartPolicy",
+		},
+	}
+}
+
+// LoadNamespacePluginPolicy reads the policy from a JSON file
+func LoadNamespacePluginPolicy(filename string) (NamespacePluginPolicy, error) {
+	var policy NamespacePluginPolicy
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return policy, fmt.Errorf("failed to read namespace plugin policy '%s': %s", filename, err)
+	}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse namespace plugin policy '%s': %s", filename, err)
+	}
+	return policy, nil
+}
+
+// allowsField checks if the field or one of its parents is allowed
+func (p NamespacePluginPolicy) allowsField(field string) bool {
+	for {
+		for _, pattern := range p.AllowedFields {
+			if ok, _ := path.Match(pattern, field); ok {
+				return true
+			}
+		}
+		i := strings.LastIndex(field, ".")
+		if i < 0 {
+			return false
+		}
+		field = field[:i]
+	}
+}
+
+// allowsImage checks if the image comes from an allowed registry
+func (p NamespacePluginPolicy) allowsImage(image string) bool {
+	return len(p.AllowedRegistries) > 0 && imageFromRegistries(image, p.AllowedRegistries)
+}
+
+// imageFromRegistries checks if the image is in one of the registries or registry paths. Images without
+// a registry are from docker.io. Any image is in an empty list of registries.
+func imageFromRegistries(image string, registries []string) bool {
+	if len(registries) == 0 {
+		return true
+	}
+	repository := parseImage(image).qualified()
+	for _, registry := range registries {
+		registry = strings.TrimSuffix(registry, "/")
+		if strings.HasPrefix(repository, registry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns why the raw plugin definition is not allowed by the policy
+func (p NamespacePluginPolicy) validate(raw []byte, opt *pluginOption) error {
+	if len(p.AllowedRegistries) == 0 {
+		return fmt.Errorf("the namespace plugin policy allows no registries")
+	}
+	var definition map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &definition); err != nil {
+		return err
+	}
+	fields := []string{}
+	for key, value := range definition {
+		// The plugin and task configs are checked a level deeper so single fields can be allowed
+		var nested map[string]json.RawMessage
+		if (key == "pluginConfig" || key == "taskConfig") && json.Unmarshal(value, &nested) == nil {
+			for nestedKey := range nested {
+				fields = append(fields, key+"."+nestedKey)
+			}
+			continue
+		}
+		fields = append(fields, key)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if !p.allowsField(field) {
+			return fmt.Errorf("field '%s' is not allowed", field)
+		}
+	}
+	if opt.PluginConfig.Image != "" && !p.allowsImage(opt.PluginConfig.Image) {
+		return fmt.Errorf("image '%s' is not from an allowed registry", opt.PluginConfig.Image)
+	}
+	return nil
+}
+
+// namespacePluginOptions returns the plugins defined in the namespace's ConfigMaps that the policy
+// allows, in the order they are applied after the cluster's plugins. A namespace plugin is left out with
+// a warning when it is not allowed, is already defined by the cluster, can not be ordered or conflicts
+// with a plugin applied before it. The cluster's plugins always win, whatever the conflict policy.
+func (m mutationHandler) namespacePluginOptions(namespace string, cluster []*pluginOption) ([]*pluginOption, []string, error) {
+	if m.namespacePlugins == nil || namespace == "" {
+		return nil, nil, nil
+	}
+	configMaps, err := m.namespacePlugins.ConfigMaps(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(configMaps, func(i, j int) bool { return configMaps[i].Name < configMaps[j].Name })
+
+	clusterPlugins := map[tfv1beta1.TaskName]bool{}
+	defined := map[tfv1beta1.TaskName]bool{}
+	for _, opt := range cluster {
+		clusterPlugins[opt.name] = true
+		defined[opt.name] = true
+	}
+	opts := []*pluginOption{}
+	warnings := []string{}
+	for _, configMap := range configMaps {
+		for _, key := range sortedKeys(configMap.Data) {
+			name := tfv1beta1.TaskName(key)
+			source := fmt.Sprintf("configmap/%s key '%s'", configMap.Name, key)
+			if defined[name] {
+				warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' from %s is ignored, the plugin is already defined", name, source))
+				continue
+			}
+			if err := validatePluginName(name); err != nil {
+				warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' from %s is ignored: %s", name, source, err))
+				continue
+			}
+			raw := []byte(configMap.Data[key])
+			opt, err := parsePluginOption(raw)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' from %s is ignored: %s", name, source, err))
+				continue
+			}
+			if err := m.namespacePluginPolicy.validate(raw, opt); err != nil {
+				warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' from %s is ignored: %s", name, source, err))
+				continue
+			}
+			image, imageWarnings, err := m.images.resolve(opt.PluginConfig.Image)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' from %s is ignored, it is denied by the image policy: %s", name, source, err))
+				continue
+			}
+			for _, warning := range imageWarnings {
+				warnings = append(warnings, fmt.Sprintf("namespace plugin '%s': %s", name, warning))
+			}
+			opt.PluginConfig.Image = image
+			opt.name = name
+			opt.namespaced = true
+			opt.allowedRegistries = m.namespacePluginPolicy.AllowedRegistries
+			defined[name] = true
+			opts = append(opts, opt)
+		}
+	}
+
+	// A namespace plugin must not break the cluster's plugins by depending on a plugin that does not
+	// exist. Dropping one may leave others without their dependency so this repeats until none are.
+	for dropped := true; dropped; {
+		dropped = false
+		valid := []*pluginOption{}
+		for _, opt := range opts {
+			if dependency := opt.unknownDependency(defined); dependency != "" {
+				warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' is ignored, it depends on unknown plugin '%s'", opt.name, dependency))
+				delete(defined, opt.name)
+				dropped = true
+				continue
+			}
+			valid = append(valid, opt)
+		}
+		opts = valid
+	}
+
+	// Namespace plugins are ordered among themselves, the cluster's plugins they depend on are already
+	// applied. A dependency cycle only drops the plugins in or depending on it.
+	opts, cyclic := orderPluginOptions(opts, clusterPlugins)
+	for _, opt := range cyclic {
+		warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' is ignored, it is in or depends on a plugin dependency cycle", opt.name))
+	}
+
+	// The first plugin to run at a task and when keeps it, which is always the cluster's plugin
+	owners := map[string]tfv1beta1.TaskName{}
+	for _, opt := range cluster {
+		if opt.PluginConfig.Task != "" {
+			owners[fmt.Sprintf("%s %s", opt.PluginConfig.When, opt.PluginConfig.Task)] = opt.name
+		}
+	}
+	ignored := map[tfv1beta1.TaskName]bool{}
+	valid := []*pluginOption{}
+	for _, opt := range opts {
+		if dependency := opt.skippedDependency(ignored); dependency != "" {
+			warnings = append(warnings, fmt.Sprintf("namespace plugin '%s' is ignored, it depends on ignored plugin '%s'", opt.name, dependency))
+			ignored[opt.name] = true
+			continue
+		}
+		if opt.PluginConfig.Task != "" {
+			key := fmt.Sprintf("%s %s", opt.PluginConfig.When, opt.PluginConfig.Task)
+			if owner, found := owners[key]; found {
+				countPluginConflict("namespace", m.conflictPolicy)
+				conflict := pluginConflict{winner: owner, loser: opt.name, reason: fmt.Sprintf("both run %s", key)}
+				warnings = append(warnings, "namespace "+conflict.String())
+				ignored[opt.name] = true
+				continue
+			}
+			owners[key] = opt.name
+		}
+		valid = append(valid, opt)
+	}
+	return valid, warnings, nil
+}
+
+// unknownDependency returns the first dependency of the plugin that is not defined or an empty string
+func (opt pluginOption) unknownDependency(defined map[tfv1beta1.TaskName]bool) tfv1beta1.TaskName {
+	for _, dependency := range opt.DependsOn {
+		if !defined[dependency] {
+			return dependency
+		}
+	}
+	return ""
+}
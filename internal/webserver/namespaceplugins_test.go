@@ -0,0 +1,162 @@
+package webserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNamespacePluginPolicyValidate(t *testing.T) {
+	policy := DefaultNamespacePluginPolicy()
+	policy.AllowedRegistries = []string{"ghcr.io/team-a", "registry.local:5000"}
+	tests := []struct {
+		name       string
+		policy     NamespacePluginPolicy
+		definition string
+		wantErr    string
+	}{
+		{
+			name:       "allowed fields",
+			policy:     policy,
+			definition: `{"dependsOn": ["monitor"], "pluginConfig": {"image": "ghcr.io/team-a/lint:1.0", "when": "Before", "task": "plan"}, "taskConfig": {"env": [{"name": "A", "value": "b"}]}}`,
+		},
+		{
+			name:       "registry with a port",
+			policy:     policy,
+			definition: `{"pluginConfig": {"image": "registry.local:5000/lint:1.0"}}`,
+		},
+		{
+			name:       "no image",
+			policy:     policy,
+			definition: `{"taskConfig": {"labels": {"team": "a"}}}`,
+		},
+		{
+			name:       "default policy allows no registries",
+			policy:     DefaultNamespacePluginPolicy(),
+			definition: `{"taskConfig": {"labels": {"team": "a"}}}`,
+			wantErr:    "the namespace plugin policy allows no registries",
+		},
+		{
+			name:       "priority",
+			policy:     policy,
+			definition: `{"priority": 100}`,
+			wantErr:    "field 'priority' is not allowed",
+		},
+		{
+			name:       "policy rules",
+			policy:     policy,
+			definition: `{"taskConfig": {"policyRules": [{"verbs": ["*"]}]}}`,
+			wantErr:    "field 'taskConfig.policyRules' is not allowed",
+		},
+		{
+			name:       "plugin config outside the allowlist",
+			policy:     policy,
+			definition: `{"pluginConfig": {"image": "ghcr.io/team-a/lint:1.0", "must": true}}`,
+			wantErr:    "field 'pluginConfig.must' is not allowed",
+		},
+		{
+			name:       "image from another registry",
+			policy:     policy,
+			definition: `{"pluginConfig": {"image": "ghcr.io/team-b/lint:1.0"}}`,
+			wantErr:    "image 'ghcr.io/team-b/lint:1.0' is not from an allowed registry",
+		},
+		{
+			name:       "image from docker.io",
+			policy:     policy,
+			definition: `{"pluginConfig": {"image": "lint:1.0"}}`,
+			wantErr:    "image 'lint:1.0' is not from an allowed registry",
+		},
+		{
+			name:       "parent field allowed",
+			policy:     NamespacePluginPolicy{AllowedFields: []string{"taskConfig"}, AllowedRegistries: []string{"ghcr.io"}},
+			definition: `{"taskConfig": {"policyRules": []}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := mustParsePluginOption(t, "lint", tt.definition)
+			err := tt.policy.validate([]byte(tt.definition), opt)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("error = %s, want none", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNamespacePluginOptions(t *testing.T) {
+	cluster := testPluginOptions(t, []testPlugin{
+		{name: "monitor", when: "After", task: "apply"},
+		{name: "setup", when: "Before", task: "init"},
+	})
+	plugin := func(definition string) string {
+		return strings.Replace(definition, "{", `{"pluginConfig": {"image": "ghcr.io/team-a/tool:1.0"}, `, 1)
+	}
+	data := map[string]string{
+		// Namespace plugins are ordered after their dependencies, whatever their names
+		"a-report": plugin(`{"dependsOn": ["lint", "monitor"]}`),
+		"lint":     plugin(`{"dependsOn": ["setup"]}`),
+		// A namespace plugin running where a cluster plugin runs loses, whatever its priority
+		"takeover": `{"pluginConfig": {"image": "ghcr.io/team-a/tool:1.0", "when": "After", "task": "apply"}}`,
+		// Cycles and their dependents only drop themselves
+		"cycle-a":  plugin(`{"dependsOn": ["cycle-b"]}`),
+		"cycle-b":  plugin(`{"dependsOn": ["cycle-a"]}`),
+		"after":    plugin(`{"dependsOn": ["cycle-a"]}`),
+		"depender": plugin(`{"dependsOn": ["takeover"]}`),
+		"monitor":  plugin(`{}`),
+		"missing":  plugin(`{"dependsOn": ["unknown"]}`),
+		"priority": plugin(`{"priority": 100}`),
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "plugins", Namespace: "team-a"}, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	policy := DefaultNamespacePluginPolicy()
+	policy.AllowedRegistries = []string{"ghcr.io/team-a"}
+
+	for _, conflictPolicy := range []ConflictPolicy{ConflictPolicyError, ConflictPolicyFirstWins, ConflictPolicyPriorityWins} {
+		t.Run(string(conflictPolicy), func(t *testing.T) {
+			m := mutationHandler{
+				conflictPolicy:        conflictPolicy,
+				namespacePlugins:      corelisters.NewConfigMapLister(indexer),
+				namespacePluginPolicy: policy,
+			}
+			opts, warnings, err := m.namespacePluginOptions("team-a", cluster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []tfv1beta1.TaskName{"lint", "a-report"}; !reflect.DeepEqual(pluginNames(opts), want) {
+				t.Errorf("plugins = %v, want %v", pluginNames(opts), want)
+			}
+			for _, opt := range opts {
+				if !opt.namespaced {
+					t.Errorf("plugin '%s' is not marked as a namespace plugin", opt.name)
+				}
+			}
+			wantWarnings := []string{
+				"namespace plugin 'monitor' from configmap/plugins key 'monitor' is ignored, the plugin is already defined",
+				"namespace plugin 'priority' from configmap/plugins key 'priority' is ignored: field 'priority' is not allowed",
+				"namespace plugin 'missing' is ignored, it depends on unknown plugin 'unknown'",
+				"namespace plugin 'after' is ignored, it is in or depends on a plugin dependency cycle",
+				"namespace plugin 'cycle-a' is ignored, it is in or depends on a plugin dependency cycle",
+				"namespace plugin 'cycle-b' is ignored, it is in or depends on a plugin dependency cycle",
+				"namespace plugin 'takeover' conflicts with 'monitor' (both run After apply), 'takeover' is not applied",
+				"namespace plugin 'depender' is ignored, it depends on ignored plugin 'takeover'",
+			}
+			if !reflect.DeepEqual(warnings, wantWarnings) {
+				t.Errorf("warnings = %q, want %q", warnings, wantWarnings)
+			}
+		})
+	}
+}
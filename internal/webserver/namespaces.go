@@ -0,0 +1,88 @@
+package webserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// namespacePluginsKey is the namespace label or annotation that enables or disables every plugin
+	// in the namespace, eg `plugin-manager.galleybytes.com/plugins: disabled`
+	namespacePluginsKey = overrideAnnotationPrefix + "plugins"
+	// namespacePluginKeyPrefix is the prefix of the namespace label or annotation that enables or
+	// disables a single plugin, eg `plugin-manager.galleybytes.com/plugin.monitor: enabled`. It takes
+	// precedence over namespacePluginsKey.
+	namespacePluginKeyPrefix = overrideAnnotationPrefix + "plugin."
+
+	namespacePluginEnabled  = "enabled"
+	namespacePluginDisabled = "disabled"
+)
+
+// namespacePolicy holds the plugin labels and annotations of a namespace. Annotations take precedence
+// over labels with the same key.
+type namespacePolicy map[string]string
+
+// namespacePolicy returns the plugin settings of the namespace. Namespaces that are not in the cache,
+// eg when they were just created, have no settings.
+func (m mutationHandler) namespacePolicy(namespace string) (namespacePolicy, error) {
+	policy := namespacePolicy{}
+	if m.namespaces == nil || namespace == "" {
+		return policy, nil
+	}
+	ns, err := m.namespaces.Get(namespace)
+	if errors.IsNotFound(err) {
+		return policy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, values := range []map[string]string{ns.Labels, ns.Annotations} {
+		for key, value := range values {
+			if key == namespacePluginsKey || strings.HasPrefix(key, namespacePluginKeyPrefix) {
+				policy[key] = value
+			}
+		}
+	}
+	return policy, nil
+}
+
+// enables checks if the plugin is applied in the namespace. A plugin's own setting wins over the
+// namespace-wide one, and plugins that are opt-in are only applied where they are enabled. The reason
+// is only set when the plugin is not applied.
+func (p namespacePolicy) enables(opt *pluginOption) (bool, string) {
+	for _, key := range []string{namespacePluginKeyPrefix + string(opt.name), namespacePluginsKey} {
+		switch p[key] {
+		case namespacePluginEnabled:
+			return true, ""
+		case namespacePluginDisabled:
+			return false, fmt.Sprintf("disabled by the namespace's '%s'", key)
+		}
+	}
+	if opt.NamespaceOptIn {
+		return false, "not enabled by the namespace"
+	}
+	return true, ""
+}
+
+// warnings describes the settings that are ignored because their value is not understood
+func (p namespacePolicy) warnings() []string {
+	warnings := []string{}
+	for _, key := range sortedKeys(p) {
+		if value := p[key]; value != namespacePluginEnabled && value != namespacePluginDisabled {
+			warnings = append(warnings, fmt.Sprintf("namespace setting '%s' is ignored, '%s' is not '%s' or '%s'", key, value, namespacePluginEnabled, namespacePluginDisabled))
+		}
+	}
+	return warnings
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
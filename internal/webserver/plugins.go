@@ -0,0 +1,233 @@
+package webserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+)
+
+// readPluginOptions reads every plugin definition in dir. They must be sorted with sortPluginOptions
+// before they are applied.
+func readPluginOptions(dir string) ([]*pluginOption, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugin directory '%s': %s", dir, err)
+	}
+	opts := []*pluginOption{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		filename := file.Name()
+		if strings.HasPrefix(filename, ".") {
+			continue
+		}
+
+		name := tfv1beta1.TaskName(filename)
+		if err := validatePluginName(name); err != nil {
+			return nil, err
+		}
+		opt, err := newPluginOption(dir, filename)
+		if err != nil {
+			return nil, err
+		}
+		opt.name = name
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// sortPluginOptions returns the plugins in the order they must be applied. Dependencies are always
+// applied before their dependents. Otherwise plugins are applied in ascending priority, then by name,
+// so that a plugin with a higher priority is applied last and wins when two plugins touch the same task.
+// Unknown dependencies and dependency cycles are returned as errors.
+func sortPluginOptions(opts []*pluginOption) ([]*pluginOption, error) {
+	known := map[tfv1beta1.TaskName]bool{}
+	for _, opt := range opts {
+		known[opt.name] = true
+	}
+	for _, opt := range opts {
+		if dependency := opt.unknownDependency(known); dependency != "" {
+			return nil, fmt.Errorf("plugin '%s' depends on unknown plugin '%s'", opt.name, dependency)
+		}
+	}
+	sorted, unsorted := orderPluginOptions(opts, nil)
+	if len(unsorted) > 0 {
+		cycle := []string{}
+		for _, opt := range unsorted {
+			cycle = append(cycle, string(opt.name))
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("plugin dependency cycle between '%s'", strings.Join(cycle, "', '"))
+	}
+	return sorted, nil
+}
+
+// orderPluginOptions orders the plugins as described by sortPluginOptions. Dependencies in applied are
+// applied before any of the plugins. The plugins that can not be ordered, because they are in or
+// depend on a dependency cycle, are returned as unsorted. Every other dependency must be one of the
+// plugins.
+func orderPluginOptions(opts []*pluginOption, applied map[tfv1beta1.TaskName]bool) (sorted, unsorted []*pluginOption) {
+	byName := map[tfv1beta1.TaskName]*pluginOption{}
+	for _, opt := range opts {
+		byName[opt.name] = opt
+	}
+
+	// inDegree is the number of unsorted dependencies and dependents is the reverse of DependsOn
+	inDegree := map[tfv1beta1.TaskName]int{}
+	dependents := map[tfv1beta1.TaskName][]tfv1beta1.TaskName{}
+	for _, opt := range opts {
+		inDegree[opt.name] = 0
+	}
+	for _, opt := range opts {
+		for _, dependency := range opt.DependsOn {
+			if applied[dependency] {
+				continue
+			}
+			inDegree[opt.name]++
+			dependents[dependency] = append(dependents[dependency], opt.name)
+		}
+	}
+
+	ready := []*pluginOption{}
+	for _, opt := range opts {
+		if inDegree[opt.name] == 0 {
+			ready = append(ready, opt)
+		}
+	}
+
+	sorted = []*pluginOption{}
+	for len(ready) > 0 {
+		sort.SliceStable(ready, func(i, j int) bool {
+			if ready[i].Priority != ready[j].Priority {
+				return ready[i].Priority < ready[j].Priority
+			}
+			return ready[i].name < ready[j].name
+		})
+		opt := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, opt)
+		for _, dependent := range dependents[opt.name] {
+			inDegree[dependent]--
+			if inDegree[dependent] == 0 {
+				ready = append(ready, byName[dependent])
+			}
+		}
+	}
+
+	for _, opt := range opts {
+		if inDegree[opt.name] > 0 {
+			unsorted = append(unsorted, opt)
+		}
+	}
+	return sorted, unsorted
+}
+
+// skippedDependency returns the first dependency of the plugin that was skipped or an empty string
+func (opt pluginOption) skippedDependency(skipped map[tfv1beta1.TaskName]bool) tfv1beta1.TaskName {
+	for _, dependency := range opt.DependsOn {
+		if skipped[dependency] {
+			return dependency
+		}
+	}
+	return ""
+}
+
+// ConflictPolicy decides which plugin is applied when plugins conflict with each other or with a
+// plugin the user defined on the Terraform
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyError fails on conflicts. Conflicts between plugin definitions fail loading the
+	// plugins and conflicts with user-defined plugins deny the admission. Namespace plugins that
+	// conflict with a user-defined plugin are skipped instead.
+	ConflictPolicyError ConflictPolicy = "error"
+	// ConflictPolicyFirstWins keeps the plugin applied first. User-defined plugins are always first.
+	ConflictPolicyFirstWins ConflictPolicy = "first-wins"
+	// ConflictPolicyPriorityWins keeps the plugin with the highest priority, or the one applied last
+	// when priorities are equal. User-defined plugins have the lowest priority.
+	ConflictPolicyPriorityWins ConflictPolicy = "priority-wins"
+)
+
+// ParseConflictPolicy returns the conflict policy named by s
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictPolicyError, ConflictPolicyFirstWins, ConflictPolicyPriorityWins:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy '%s'", s)
+}
+
+// pluginConflict describes a conflict that was resolved by dropping the loser
+type pluginConflict struct {
+	winner tfv1beta1.TaskName
+	loser  tfv1beta1.TaskName
+	reason string
+}
+
+func (c pluginConflict) String() string {
+	return fmt.Sprintf("plugin '%s' conflicts with '%s' (%s), '%s' is not applied", c.loser, c.winner, c.reason, c.loser)
+}
+
+// resolvePluginConflicts finds plugin definitions that inject a plugin for the same task and when.
+// The ordered plugins that are still applied are returned along with the conflicts that dropped the
+// others.
+func resolvePluginConflicts(opts []*pluginOption, policy ConflictPolicy) ([]*pluginOption, []pluginConflict, error) {
+	conflicts := []pluginConflict{}
+	dropped := map[tfv1beta1.TaskName]bool{}
+	// owners holds the index of the plugin currently winning each task and when
+	owners := map[string]int{}
+	for i, opt := range opts {
+		if opt.PluginConfig.Task == "" {
+			continue
+		}
+		key := fmt.Sprintf("%s %s", opt.PluginConfig.When, opt.PluginConfig.Task)
+		j, found := owners[key]
+		if !found {
+			owners[key] = i
+			continue
+		}
+
+		reason := fmt.Sprintf("both run %s", key)
+		first := opts[j]
+		switch policy {
+		case ConflictPolicyError:
+			return nil, nil, fmt.Errorf("plugins '%s' and '%s' conflict: %s", first.name, opt.name, reason)
+		case ConflictPolicyFirstWins:
+			dropped[opt.name] = true
+			conflicts = append(conflicts, pluginConflict{winner: first.name, loser: opt.name, reason: reason})
+		default:
+			if first.Priority > opt.Priority {
+				dropped[opt.name] = true
+				conflicts = append(conflicts, pluginConflict{winner: first.name, loser: opt.name, reason: reason})
+			} else {
+				dropped[first.name] = true
+				owners[key] = i
+				conflicts = append(conflicts, pluginConflict{winner: opt.name, loser: first.name, reason: reason})
+			}
+		}
+	}
+
+	kept := []*pluginOption{}
+	for _, opt := range opts {
+		if !dropped[opt.name] {
+			kept = append(kept, opt)
+		}
+	}
+	return kept, conflicts, nil
+}
+
+// userPluginConflict checks if the Terraform defines a plugin with the same name that the manager does
+// not own, see injectedRecord. Plugins identical to the one the plugin definition injects are not a
+// conflict either, eg when they were injected before injections were recorded.
+func userPluginConflict(tf *tfv1beta1.Terraform, opt *pluginOption, injected injectedRecord) bool {
+	plugin, found := tf.Spec.Plugins[opt.name]
+	if !found || injected.owns(tf, opt.name) {
+		return false
+	}
+	return !reflect.DeepEqual(plugin, opt.PluginConfig)
+}
@@ -0,0 +1,258 @@
+package webserver
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+)
+
+// testPlugin is the part of a plugin definition the ordering and conflict tests care about
+type testPlugin struct {
+	name      tfv1beta1.TaskName
+	priority  int
+	dependsOn []tfv1beta1.TaskName
+	when      string
+	task      tfv1beta1.TaskName
+}
+
+func testPluginOptions(t *testing.T, plugins []testPlugin) []*pluginOption {
+	t.Helper()
+	opts := []*pluginOption{}
+	for _, p := range plugins {
+		dependsOn := make([]string, len(p.dependsOn))
+		for i, dependency := range p.dependsOn {
+			dependsOn[i] = fmt.Sprintf("%q", dependency)
+		}
+		definition := fmt.Sprintf(`{
+			"priority": %d,
+			"dependsOn": [%s],
+			"pluginConfig": {"image": "busybox:1.36", "when": %q, "task": %q}
+		}`, p.priority, strings.Join(dependsOn, ", "), p.when, p.task)
+		opts = append(opts, mustParsePluginOption(t, p.name, definition))
+	}
+	return opts
+}
+
+func pluginNames(opts []*pluginOption) []tfv1beta1.TaskName {
+	names := []tfv1beta1.TaskName{}
+	for _, opt := range opts {
+		names = append(names, opt.name)
+	}
+	return names
+}
+
+func TestSortPluginOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		plugins []testPlugin
+		want    []tfv1beta1.TaskName
+		wantErr string
+	}{
+		{
+			name:    "no plugins",
+			plugins: []testPlugin{},
+			want:    []tfv1beta1.TaskName{},
+		},
+		{
+			name:    "by name",
+			plugins: []testPlugin{{name: "c"}, {name: "a"}, {name: "b"}},
+			want:    []tfv1beta1.TaskName{"a", "b", "c"},
+		},
+		{
+			name:    "higher priorities last",
+			plugins: []testPlugin{{name: "a", priority: 10}, {name: "b"}, {name: "c", priority: -1}},
+			want:    []tfv1beta1.TaskName{"c", "b", "a"},
+		},
+		{
+			name: "dependencies before dependents regardless of priority",
+			plugins: []testPlugin{
+				{name: "a", dependsOn: []tfv1beta1.TaskName{"b"}},
+				{name: "b", priority: 10},
+				{name: "c", priority: 5},
+			},
+			want: []tfv1beta1.TaskName{"c", "b", "a"},
+		},
+		{
+			name: "chain",
+			plugins: []testPlugin{
+				{name: "a", dependsOn: []tfv1beta1.TaskName{"b"}},
+				{name: "b", dependsOn: []tfv1beta1.TaskName{"c"}},
+				{name: "c"},
+			},
+			want: []tfv1beta1.TaskName{"c", "b", "a"},
+		},
+		{
+			name:    "unknown dependency",
+			plugins: []testPlugin{{name: "a", dependsOn: []tfv1beta1.TaskName{"missing"}}},
+			wantErr: "plugin 'a' depends on unknown plugin 'missing'",
+		},
+		{
+			name: "cycle",
+			plugins: []testPlugin{
+				{name: "a", dependsOn: []tfv1beta1.TaskName{"b"}},
+				{name: "b", dependsOn: []tfv1beta1.TaskName{"a"}},
+				{name: "c"},
+			},
+			wantErr: "plugin dependency cycle between 'a', 'b'",
+		},
+		{
+			name:    "self dependency",
+			plugins: []testPlugin{{name: "a", dependsOn: []tfv1beta1.TaskName{"a"}}},
+			wantErr: "plugin dependency cycle between 'a'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted, err := sortPluginOptions(testPluginOptions(t, tt.plugins))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pluginNames(sorted); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePluginConflicts(t *testing.T) {
+	plugins := []testPlugin{
+		{name: "a", when: "After", task: "apply", priority: 1},
+		{name: "b", when: "After", task: "apply"},
+		{name: "c", when: "Before", task: "apply"},
+		{name: "d"},
+		{name: "e"},
+	}
+	tests := []struct {
+		policy        ConflictPolicy
+		plugins       []testPlugin
+		want          []tfv1beta1.TaskName
+		wantConflicts []pluginConflict
+		wantErr       bool
+	}{
+		{
+			policy:  ConflictPolicyError,
+			plugins: plugins,
+			wantErr: true,
+		},
+		{
+			policy:        ConflictPolicyFirstWins,
+			plugins:       plugins,
+			want:          []tfv1beta1.TaskName{"a", "c", "d", "e"},
+			wantConflicts: []pluginConflict{{winner: "a", loser: "b", reason: "both run After apply"}},
+		},
+		{
+			policy:        ConflictPolicyPriorityWins,
+			plugins:       plugins,
+			want:          []tfv1beta1.TaskName{"a", "c", "d", "e"},
+			wantConflicts: []pluginConflict{{winner: "a", loser: "b", reason: "both run After apply"}},
+		},
+		{
+			// With equal priorities the plugin applied last wins
+			policy:        ConflictPolicyPriorityWins,
+			plugins:       []testPlugin{{name: "a", when: "After", task: "apply"}, {name: "b", when: "After", task: "apply"}},
+			want:          []tfv1beta1.TaskName{"b"},
+			wantConflicts: []pluginConflict{{winner: "b", loser: "a", reason: "both run After apply"}},
+		},
+		{
+			policy:        ConflictPolicyError,
+			plugins:       []testPlugin{{name: "a", when: "After", task: "apply"}, {name: "b", when: "Before", task: "apply"}, {name: "c"}},
+			want:          []tfv1beta1.TaskName{"a", "b", "c"},
+			wantConflicts: []pluginConflict{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			kept, conflicts, err := resolvePluginConflicts(testPluginOptions(t, tt.plugins), tt.policy)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("conflict was not an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pluginNames(kept); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("conflicts = %v, want %v", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+func TestUserPluginConflict(t *testing.T) {
+	opt := mustParsePluginOption(t, "monitor", `{"pluginConfig": {"image": "monitor:0.2.0", "when": "After", "task": "apply"}}`)
+	injectedBefore := mustParsePluginOption(t, "monitor", `{"pluginConfig": {"image": "monitor:0.1.0", "when": "After", "task": "apply"}}`)
+	userDefined := mustParsePluginOption(t, "monitor", `{"pluginConfig": {"image": "my-monitor:1.0.0", "when": "After", "task": "apply"}}`)
+
+	// terraform returns a Terraform with the plugin and, when it is set, the record of the plugin the
+	// manager injected
+	terraform := func(plugin *pluginOption, record *pluginOption) *tfv1beta1.Terraform {
+		tf := &tfv1beta1.Terraform{}
+		if plugin != nil {
+			tf.Spec.Plugins = map[tfv1beta1.TaskName]tfv1beta1.Plugin{"monitor": plugin.PluginConfig}
+		}
+		if record != nil {
+			injected := injectedRecord{Plugins: map[tfv1beta1.TaskName]string{"monitor": pluginHash(record.PluginConfig)}}
+			if err := injected.write(tf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tf
+	}
+	tests := []struct {
+		name string
+		tf   *tfv1beta1.Terraform
+		want bool
+	}{
+		{name: "no plugin", tf: terraform(nil, nil), want: false},
+		{name: "identical plugin", tf: terraform(opt, nil), want: false},
+		{name: "user-defined plugin", tf: terraform(userDefined, nil), want: true},
+		{name: "plugin injected from a previous definition", tf: terraform(injectedBefore, injectedBefore), want: false},
+		{name: "injected plugin the user changed since", tf: terraform(userDefined, injectedBefore), want: true},
+		{name: "record of another plugin", tf: terraform(userDefined, opt), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userPluginConflict(tt.tf, opt, readInjectedRecord(tt.tf)); got != tt.want {
+				t.Errorf("userPluginConflict() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectedRecordUpdate(t *testing.T) {
+	monitor := mustParsePluginOption(t, "monitor", `{"pluginConfig": {"image": "monitor:0.2.0", "when": "After", "task": "apply"}}`)
+	tf := &tfv1beta1.Terraform{}
+	tf.Spec.Plugins = map[tfv1beta1.TaskName]tfv1beta1.Plugin{"monitor": monitor.PluginConfig}
+	record := injectedRecord{Plugins: map[tfv1beta1.TaskName]string{"removed": "sha256:0"}}
+
+	record.update(tf, []*pluginOption{monitor}, nil)
+	if err := record.write(tf); err != nil {
+		t.Fatal(err)
+	}
+	want := map[tfv1beta1.TaskName]string{"monitor": pluginHash(monitor.PluginConfig)}
+	if got := readInjectedRecord(tf).Plugins; !reflect.DeepEqual(got, want) {
+		t.Errorf("record = %v, want %v", got, want)
+	}
+
+	delete(tf.Spec.Plugins, "monitor")
+	record.update(tf, nil, nil)
+	if err := record.write(tf); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := tf.ObjectMeta.Annotations[injectedAnnotation]; found {
+		t.Error("empty record was not removed")
+	}
+}
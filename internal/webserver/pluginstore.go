@@ -0,0 +1,194 @@
+package webserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+)
+
+// pluginSet is a valid set of the cluster's plugin definitions
+type pluginSet struct {
+	// opts are the plugins in the order they are applied, without the ones that lost a conflict
+	opts []*pluginOption
+	// conflicts are the conflicts that were resolved by dropping a plugin
+	conflicts []pluginConflict
+	// secrets are the secret env vars of every plugin definition, including the dropped ones
+	secrets secretEnv
+	// imageWarnings describe the images the image policy allows but does not recommend
+	imageWarnings []string
+	// checksum identifies the content of the plugin directory the set was loaded from
+	checksum string
+}
+
+// loadPluginSet reads and validates every plugin definition in dir. The set is only valid when every
+// definition parses, every image is allowed by the image policy, the dependencies form no cycle and the
+// conflicts can be resolved by the policy. Images are pinned to the digests the image policy maps them
+// to.
+func loadPluginSet(dir string, policy ConflictPolicy, images ImagePolicy) (*pluginSet, error) {
+	checksum, err := pluginDirChecksum(dir)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := readPluginOptions(dir)
+	if err != nil {
+		return nil, err
+	}
+	set := &pluginSet{checksum: checksum, secrets: secretEnv{}, imageWarnings: []string{}}
+	for _, opt := range opts {
+		set.secrets = append(set.secrets, opt.SecretEnv...)
+		image, warnings, err := images.resolve(opt.PluginConfig.Image)
+		if err != nil {
+			return nil, fmt.Errorf("plugin '%s' is denied by the image policy: %s", opt.name, err)
+		}
+		for _, warning := range warnings {
+			set.imageWarnings = append(set.imageWarnings, fmt.Sprintf("plugin '%s': %s", opt.name, warning))
+		}
+		opt.PluginConfig.Image = image
+	}
+	opts, err = sortPluginOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	set.opts, set.conflicts, err = resolvePluginConflicts(opts, policy)
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// pluginDirChecksum hashes the names and content of the plugin definitions in dir
+func pluginDirChecksum(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read plugin directory '%s': %s", dir, err)
+	}
+	hash := sha256.New()
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return "", fmt.Errorf("failed to read plugin definition '%s': %s", file.Name(), err)
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", file.Name(), len(b))
+		hash.Write(b)
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// options returns a copy of the plugins so an admission request can change them, eg with overrides
+func (s *pluginSet) options() []*pluginOption {
+	opts := make([]*pluginOption, len(s.opts))
+	for i, opt := range s.opts {
+		opts[i] = opt.clone()
+	}
+	return opts
+}
+
+// clone copies the plugin option including the task options that are changed while it is applied
+func (opt *pluginOption) clone() *pluginOption {
+	clone := *opt
+	clone.TaskOption = *opt.TaskOption.DeepCopy()
+	clone.ExtraTaskOptions = make([]tfv1beta1.TaskOption, len(opt.ExtraTaskOptions))
+	for i := range opt.ExtraTaskOptions {
+		clone.ExtraTaskOptions[i] = *opt.ExtraTaskOptions[i].DeepCopy()
+	}
+	return &clone
+}
+
+// pluginStore holds the last valid set of the cluster's plugin definitions. The plugin directory is
+// reloaded when its content changes. An invalid set is reported and the last valid set is kept.
+type pluginStore struct {
+	dir    string
+	policy ConflictPolicy
+	images ImagePolicy
+	// onError is called with the reason a changed plugin directory is not loaded
+	onError func(error)
+
+	current atomic.Pointer[pluginSet]
+	// failed is the checksum of the content that was last reported as not valid
+	failed string
+}
+
+// newPluginStore loads the plugin directory and fails when the plugin definitions are not valid
+func newPluginStore(dir string, policy ConflictPolicy, images ImagePolicy, onError func(error)) (*pluginStore, error) {
+	s := &pluginStore{dir: dir, policy: policy, images: images, onError: onError}
+	set, err := loadPluginSet(dir, policy, images)
+	if err != nil {
+		countPluginLoad("failure")
+		return nil, fmt.Errorf("invalid plugins in '%s': %s", dir, err)
+	}
+	s.store(set)
+	return s, nil
+}
+
+// get returns the last valid plugin set
+func (s *pluginStore) get() *pluginSet {
+	return s.current.Load()
+}
+
+func (s *pluginStore) store(set *pluginSet) {
+	countPluginLoad("success")
+	names := make([]tfv1beta1.TaskName, len(set.opts))
+	for i, opt := range set.opts {
+		names[i] = opt.name
+	}
+	logger.Info("Loaded plugins", "dir", s.dir, "plugins", names, "checksum", set.checksum)
+	for _, conflict := range set.conflicts {
+		logger.Info("Plugin conflict", "winner", conflict.winner, "loser", conflict.loser, "reason", conflict.reason)
+		countPluginConflict("load", s.policy)
+	}
+	for _, warning := range set.imageWarnings {
+		logger.Info("Plugin image warning", "warning", warning)
+	}
+	s.current.Store(set)
+}
+
+// run reloads the plugin directory every interval until the context is done
+func (s *pluginStore) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reload()
+		}
+	}
+}
+
+// reload loads the plugin directory when its content changed. Mounted ConfigMaps are updated by
+// swapping a symlink, so the content is compared rather than modification times. Content that is not
+// valid is only reported once.
+func (s *pluginStore) reload() {
+	checksum, err := pluginDirChecksum(s.dir)
+	if err != nil {
+		logger.Error(err, "Failed to check the plugin directory for changes", "dir", s.dir)
+		return
+	}
+	if checksum == s.get().checksum || checksum == s.failed {
+		return
+	}
+	set, err := loadPluginSet(s.dir, s.policy, s.images)
+	if err != nil {
+		s.failed = checksum
+		countPluginLoad("failure")
+		err = fmt.Errorf("invalid plugins in '%s', keeping the plugins loaded before: %s", s.dir, err)
+		logger.Error(err, "Failed to reload plugins", "dir", s.dir, "checksum", checksum)
+		if s.onError != nil {
+			s.onError(err)
+		}
+		return
+	}
+	s.failed = ""
+	s.store(set)
+}
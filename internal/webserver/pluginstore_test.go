@@ -0,0 +1,135 @@
+package webserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+)
+
+func writePlugin(t *testing.T, dir, name, definition string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(definition), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPluginStore(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "monitor", `{"pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"}}`)
+	writePlugin(t, dir, "setup", `{"dependsOn": ["monitor"], "pluginConfig": {"image": "busybox:1.36", "when": "Before", "task": "init"}}`)
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := []error{}
+	store, err := newPluginStore(dir, ConflictPolicyPriorityWins, DefaultImagePolicy(), func(err error) { errs = append(errs, err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tfv1beta1.TaskName{"monitor", "setup"}
+	if got := pluginNames(store.get().opts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("plugins = %v, want %v", got, want)
+	}
+
+	// Unchanged content is not reloaded
+	loaded := store.get()
+	store.reload()
+	if store.get() != loaded {
+		t.Error("unchanged plugins were reloaded")
+	}
+
+	// A cycle is reported once and the last valid plugins are kept
+	writePlugin(t, dir, "monitor", `{"dependsOn": ["setup"], "pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"}}`)
+	store.reload()
+	store.reload()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "plugin dependency cycle between 'monitor', 'setup'") {
+		t.Errorf("errors = %v, want one dependency cycle", errs)
+	}
+	if store.get() != loaded {
+		t.Error("invalid plugins replaced the last valid plugins")
+	}
+
+	// Fixing the definition loads it
+	writePlugin(t, dir, "monitor", `{"priority": 1, "pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"}}`)
+	store.reload()
+	if store.get() == loaded || store.get().opts[0].Priority != 1 {
+		t.Error("valid plugins were not reloaded")
+	}
+}
+
+func TestNewPluginStoreFailsOnInvalidPlugins(t *testing.T) {
+	tests := map[string]map[string]string{
+		"not json": {
+			"monitor": `{`,
+		},
+		"unknown dependency": {
+			"monitor": `{"dependsOn": ["missing"]}`,
+		},
+		"conflict under the error policy": {
+			"a": `{"pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"}}`,
+			"b": `{"pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"}}`,
+		},
+		"dotted name": {
+			"monitor.json": `{}`,
+		},
+	}
+	for name, files := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for file, definition := range files {
+				writePlugin(t, dir, file, definition)
+			}
+			if _, err := newPluginStore(dir, ConflictPolicyError, DefaultImagePolicy(), nil); err == nil {
+				t.Error("invalid plugins were loaded")
+			}
+		})
+	}
+}
+
+func TestPluginSetOptionsAreCopies(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "monitor", `{"taskConfig": {"env": [{"name": "LOG_LEVEL", "value": "info"}]}}`)
+	set, err := loadPluginSet(dir, ConflictPolicyPriorityWins, DefaultImagePolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := set.options()
+	opts[0].TaskOption.Env[0].Value = "debug"
+	opts[0].PluginConfig.Image = "busybox:1.36"
+	if set.opts[0].TaskOption.Env[0].Value != "info" || set.opts[0].PluginConfig.Image != "" {
+		t.Error("changing the options of an admission changed the loaded plugins")
+	}
+}
+
+func TestLoadPluginSetAppliesImagePolicy(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "monitor", `{"pluginConfig": {"image": "ghcr.io/galleybytes/monitor:0.1.3"}}`)
+	writePlugin(t, dir, "setup", `{"pluginConfig": {"image": "ghcr.io/galleybytes/setup"}}`)
+
+	images := ImagePolicy{
+		Latest:  LatestWarn,
+		Digests: map[string]string{"ghcr.io/galleybytes/monitor:0.1.3": "sha256:abc"},
+	}
+	set, err := loadPluginSet(dir, ConflictPolicyPriorityWins, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := set.opts[0].PluginConfig.Image; image != "ghcr.io/galleybytes/monitor:0.1.3@sha256:abc" {
+		t.Errorf("image = %s, want it pinned to its digest", image)
+	}
+	want := []string{"plugin 'setup': image 'ghcr.io/galleybytes/setup' uses the latest tag, pin it to a version or digest"}
+	if !reflect.DeepEqual(set.imageWarnings, want) {
+		t.Errorf("image warnings = %q, want %q", set.imageWarnings, want)
+	}
+
+	images.Latest = LatestReject
+	_, err = loadPluginSet(dir, ConflictPolicyPriorityWins, images)
+	if want := "plugin 'setup' is denied by the image policy: image 'ghcr.io/galleybytes/setup' uses the latest tag"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,211 @@
+package webserver
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// allTasks is the task name a task option uses to target every task
+const allTasks tfv1beta1.TaskName = "*"
+
+// validateExtraTaskOptions returns why the plugin's extra task options cannot be applied
+func (opt pluginOption) validateExtraTaskOptions() error {
+	for i, taskOption := range opt.ExtraTaskOptions {
+		if len(taskOption.For) == 0 {
+			return fmt.Errorf("extraTaskConfigs[%d] does not list the tasks it is for", i)
+		}
+	}
+	return nil
+}
+
+// addExtraTaskOption adds one of the plugin's extra task options to the Terraform. The task options it
+// adds are marked in owned, the indexes of the task options the manager owns. The returned warnings
+// describe what it had to leave out.
+//
+// The operator applies every task option that targets a task, so the plugin never overrides what the
+// user's task options set for a task: the env vars, labels, annotations and restart policy a user's
+// task option sets for a task are dropped from the extra task option for that task only. Tasks that
+// drop different fields get task options of their own. The restart policy defaults to Always, like
+// the plugin's own task option, unless the user sets it for the task.
+//
+// The user's task options are never changed, even when they are for the same tasks. A task option the
+// manager owns for the same tasks is merged into the same way the plugin's own task option is, ie the
+// plugin wins. Otherwise a task option is appended.
+func addExtraTaskOption(tf *tfv1beta1.Terraform, pluginName tfv1beta1.TaskName, extra tfv1beta1.TaskOption, owned map[int]bool) []string {
+	// Tasks are grouped, in the order they are listed, by the fields the user's task options set for them
+	groups := [][]tfv1beta1.TaskName{}
+	groupDrops := []map[string]bool{}
+	groupIndex := map[string]int{}
+	for _, task := range extra.For {
+		drops := userTaskOptionFields(tf, task, extra, owned)
+		keys := make([]string, 0, len(drops))
+		for key := range drops {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		id := strings.Join(keys, ",")
+		i, found := groupIndex[id]
+		if !found {
+			i = len(groups)
+			groupIndex[id] = i
+			groups = append(groups, []tfv1beta1.TaskName{})
+			groupDrops = append(groupDrops, drops)
+		}
+		groups[i] = append(groups[i], task)
+	}
+
+	warnings := []string{}
+	for i, tasks := range groups {
+		taskOption, dropped := withoutFields(extra, groupDrops[i])
+		taskOption.For = tasks
+		if taskOption.RestartPolicy == "" && !groupDrops[i]["restartPolicy"] {
+			taskOption.RestartPolicy = corev1.RestartPolicyAlways
+		}
+
+		index := -1
+		for j, existing := range tf.Spec.TaskOptions {
+			if owned[j] && sameTasks(existing.For, tasks) {
+				index = j
+				break
+			}
+		}
+		if index > -1 {
+			existing := tf.Spec.TaskOptions[index]
+			// Unlike the plugin's own task option, an extra task option only replaces the scalar fields it sets
+			if extra.RestartPolicy == "" {
+				taskOption.RestartPolicy = existing.RestartPolicy
+			}
+			if reflect.DeepEqual(taskOption.Resources, tfv1beta1.TaskOption{}.Resources) {
+				taskOption.Resources = existing.Resources
+			}
+			if reflect.DeepEqual(taskOption.Script, tfv1beta1.TaskOption{}.Script) {
+				existing.Script.DeepCopyInto(&taskOption.Script)
+			}
+			tf.Spec.TaskOptions[index] = mergeTaskOptions(existing, taskOption)
+		} else {
+			tf.Spec.TaskOptions = append(tf.Spec.TaskOptions, taskOption)
+			owned[len(tf.Spec.TaskOptions)-1] = true
+		}
+
+		if len(dropped) > 0 {
+			warnings = append(warnings, fmt.Sprintf("plugin '%s' task config for '%s' does not override %s, already set for these tasks",
+				pluginName, joinTaskNames(tasks), strings.Join(dropped, ", ")))
+		}
+	}
+	return warnings
+}
+
+// userTaskOptionFields returns the fields of the extra task option that the user's task options set for
+// the task, and `restartPolicy` when they set it. Task options the manager owns are not the user's.
+func userTaskOptionFields(tf *tfv1beta1.Terraform, task tfv1beta1.TaskName, extra tfv1beta1.TaskOption, owned map[int]bool) map[string]bool {
+	fields := map[string]bool{}
+	for i, taskOption := range tf.Spec.TaskOptions {
+		if owned[i] || len(overlappingTasks(taskOption.For, []tfv1beta1.TaskName{task})) == 0 {
+			continue
+		}
+		for _, e := range extra.Env {
+			if hasEnv(taskOption, e.Name) {
+				fields["env."+e.Name] = true
+			}
+		}
+		for k := range extra.Labels {
+			if _, found := taskOption.Labels[k]; found {
+				fields["labels."+k] = true
+			}
+		}
+		for k := range extra.Annotations {
+			if _, found := taskOption.Annotations[k]; found {
+				fields["annotations."+k] = true
+			}
+		}
+		if taskOption.RestartPolicy != "" {
+			fields["restartPolicy"] = true
+		}
+	}
+	return fields
+}
+
+// withoutFields returns a copy of the task option without the fields and the sorted fields it set
+func withoutFields(taskOption tfv1beta1.TaskOption, fields map[string]bool) (tfv1beta1.TaskOption, []string) {
+	taskOption = *taskOption.DeepCopy()
+	dropped := []string{}
+	env := taskOption.Env[:0]
+	for _, e := range taskOption.Env {
+		if fields["env."+e.Name] {
+			dropped = append(dropped, "env."+e.Name)
+			continue
+		}
+		env = append(env, e)
+	}
+	taskOption.Env = env
+	for k := range taskOption.Labels {
+		if fields["labels."+k] {
+			delete(taskOption.Labels, k)
+			dropped = append(dropped, "labels."+k)
+		}
+	}
+	for k := range taskOption.Annotations {
+		if fields["annotations."+k] {
+			delete(taskOption.Annotations, k)
+			dropped = append(dropped, "annotations."+k)
+		}
+	}
+	if fields["restartPolicy"] && taskOption.RestartPolicy != "" {
+		taskOption.RestartPolicy = ""
+		dropped = append(dropped, "restartPolicy")
+	}
+	sort.Strings(dropped)
+	return taskOption, dropped
+}
+
+// sameTasks returns true when both lists target the same tasks, regardless of order
+func sameTasks(a, b []tfv1beta1.TaskName) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, task := range b {
+		if !containsTask(a, task) {
+			return false
+		}
+	}
+	for _, task := range a {
+		if !containsTask(b, task) {
+			return false
+		}
+	}
+	return true
+}
+
+// overlappingTasks returns the tasks of b that a also targets
+func overlappingTasks(a, b []tfv1beta1.TaskName) []tfv1beta1.TaskName {
+	overlap := []tfv1beta1.TaskName{}
+	for _, task := range b {
+		if containsTask(a, allTasks) || task == allTasks || containsTask(a, task) {
+			overlap = append(overlap, task)
+		}
+	}
+	return overlap
+}
+
+func containsTask(tasks []tfv1beta1.TaskName, task tfv1beta1.TaskName) bool {
+	for _, t := range tasks {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEnv(taskOption tfv1beta1.TaskOption, name string) bool {
+	for _, env := range taskOption.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package webserver
+
+import (
+	"reflect"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func tasks(names ...tfv1beta1.TaskName) []tfv1beta1.TaskName {
+	return names
+}
+
+func TestAddExtraTaskOption(t *testing.T) {
+	extra := tfv1beta1.TaskOption{
+		For:    tasks("plan", "apply"),
+		Env:    []corev1.EnvVar{{Name: "REGION", Value: "a"}, {Name: "ZONE", Value: "b"}},
+		Labels: map[string]string{"team": "platform"},
+	}
+	tests := []struct {
+		name         string
+		extra        tfv1beta1.TaskOption
+		existing     []tfv1beta1.TaskOption
+		owned        map[int]bool
+		want         []tfv1beta1.TaskOption
+		wantOwned    map[int]bool
+		wantWarnings []string
+	}{
+		{
+			name:      "no task options",
+			extra:     extra,
+			want:      []tfv1beta1.TaskOption{withRestartPolicy(extra, corev1.RestartPolicyAlways)},
+			wantOwned: map[int]bool{0: true},
+		},
+		{
+			name:  "user task option for other tasks",
+			extra: extra,
+			existing: []tfv1beta1.TaskOption{
+				{For: tasks("init"), Env: []corev1.EnvVar{{Name: "REGION", Value: "user"}}, RestartPolicy: corev1.RestartPolicyNever},
+			},
+			want: []tfv1beta1.TaskOption{
+				{For: tasks("init"), Env: []corev1.EnvVar{{Name: "REGION", Value: "user"}}, RestartPolicy: corev1.RestartPolicyNever},
+				withRestartPolicy(extra, corev1.RestartPolicyAlways),
+			},
+			wantOwned: map[int]bool{1: true},
+		},
+		{
+			name:  "partial overlap only drops fields for the overlapping task",
+			extra: extra,
+			existing: []tfv1beta1.TaskOption{
+				{For: tasks("apply", "destroy"), Env: []corev1.EnvVar{{Name: "REGION", Value: "user"}}},
+			},
+			want: []tfv1beta1.TaskOption{
+				{For: tasks("apply", "destroy"), Env: []corev1.EnvVar{{Name: "REGION", Value: "user"}}},
+				{
+					For:           tasks("plan"),
+					Env:           []corev1.EnvVar{{Name: "REGION", Value: "a"}, {Name: "ZONE", Value: "b"}},
+					Labels:        map[string]string{"team": "platform"},
+					RestartPolicy: corev1.RestartPolicyAlways,
+				},
+				{
+					For:           tasks("apply"),
+					Env:           []corev1.EnvVar{{Name: "ZONE", Value: "b"}},
+					Labels:        map[string]string{"team": "platform"},
+					RestartPolicy: corev1.RestartPolicyAlways,
+				},
+			},
+			wantOwned:    map[int]bool{1: true, 2: true},
+			wantWarnings: []string{"plugin 'monitor' task config for 'apply' does not override env.REGION, already set for these tasks"},
+		},
+		{
+			name:  "user task option for every task",
+			extra: extra,
+			existing: []tfv1beta1.TaskOption{
+				{For: tasks("*"), Labels: map[string]string{"team": "user"}, RestartPolicy: corev1.RestartPolicyOnFailure},
+			},
+			want: []tfv1beta1.TaskOption{
+				{For: tasks("*"), Labels: map[string]string{"team": "user"}, RestartPolicy: corev1.RestartPolicyOnFailure},
+				{For: tasks("plan", "apply"), Env: extra.Env, Labels: map[string]string{}},
+			},
+			wantOwned:    map[int]bool{1: true},
+			wantWarnings: []string{"plugin 'monitor' task config for 'plan, apply' does not override labels.team, already set for these tasks"},
+		},
+		{
+			name:  "user task option for the same tasks is not changed",
+			extra: withRestartPolicy(extra, corev1.RestartPolicyNever),
+			existing: []tfv1beta1.TaskOption{
+				{For: tasks("apply", "plan"), Env: []corev1.EnvVar{{Name: "ZONE", Value: "user"}}, RestartPolicy: corev1.RestartPolicyOnFailure},
+			},
+			want: []tfv1beta1.TaskOption{
+				{For: tasks("apply", "plan"), Env: []corev1.EnvVar{{Name: "ZONE", Value: "user"}}, RestartPolicy: corev1.RestartPolicyOnFailure},
+				{For: tasks("plan", "apply"), Env: []corev1.EnvVar{{Name: "REGION", Value: "a"}}, Labels: map[string]string{"team": "platform"}},
+			},
+			wantOwned:    map[int]bool{1: true},
+			wantWarnings: []string{"plugin 'monitor' task config for 'plan, apply' does not override env.ZONE, restartPolicy, already set for these tasks"},
+		},
+		{
+			name:  "task option the manager added before is merged into",
+			extra: extra,
+			existing: []tfv1beta1.TaskOption{
+				{For: tasks("apply", "plan"), Env: []corev1.EnvVar{{Name: "REGION", Value: "old"}, {Name: "OLD", Value: "c"}}, RestartPolicy: corev1.RestartPolicyAlways},
+			},
+			owned: map[int]bool{0: true},
+			want: []tfv1beta1.TaskOption{
+				{
+					For:           tasks("apply", "plan"),
+					Env:           []corev1.EnvVar{{Name: "REGION", Value: "a"}, {Name: "OLD", Value: "c"}, {Name: "ZONE", Value: "b"}},
+					Labels:        map[string]string{"team": "platform"},
+					RestartPolicy: corev1.RestartPolicyAlways,
+				},
+			},
+			wantOwned: map[int]bool{0: true},
+		},
+		{
+			name:  "only the owned task option for the same tasks is merged into",
+			extra: extra,
+			existing: []tfv1beta1.TaskOption{
+				{For: tasks("plan", "apply"), Labels: map[string]string{"team": "user"}},
+				{For: tasks("plan", "apply"), Env: []corev1.EnvVar{{Name: "REGION", Value: "old"}}, RestartPolicy: corev1.RestartPolicyAlways},
+			},
+			owned: map[int]bool{1: true},
+			want: []tfv1beta1.TaskOption{
+				{For: tasks("plan", "apply"), Labels: map[string]string{"team": "user"}},
+				{
+					For:           tasks("plan", "apply"),
+					Env:           []corev1.EnvVar{{Name: "REGION", Value: "a"}, {Name: "ZONE", Value: "b"}},
+					RestartPolicy: corev1.RestartPolicyAlways,
+				},
+			},
+			wantOwned:    map[int]bool{1: true},
+			wantWarnings: []string{"plugin 'monitor' task config for 'plan, apply' does not override labels.team, already set for these tasks"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := &tfv1beta1.Terraform{}
+			tf.Spec.TaskOptions = tt.existing
+			owned := map[int]bool{}
+			for i := range tt.owned {
+				owned[i] = true
+			}
+			warnings := addExtraTaskOption(tf, "monitor", tt.extra, owned)
+			if !reflect.DeepEqual(tf.Spec.TaskOptions, tt.want) {
+				t.Errorf("task options = %+v, want %+v", tf.Spec.TaskOptions, tt.want)
+			}
+			if !reflect.DeepEqual(owned, tt.wantOwned) {
+				t.Errorf("owned = %v, want %v", owned, tt.wantOwned)
+			}
+			if len(warnings) > 0 || len(tt.wantWarnings) > 0 {
+				if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+					t.Errorf("warnings = %q, want %q", warnings, tt.wantWarnings)
+				}
+			}
+			if tt.extra.Labels["team"] != "platform" || len(tt.extra.Env) != 2 {
+				t.Error("the plugin's extra task option was changed")
+			}
+		})
+	}
+}
+
+func withRestartPolicy(taskOption tfv1beta1.TaskOption, restartPolicy corev1.RestartPolicy) tfv1beta1.TaskOption {
+	taskOption = *taskOption.DeepCopy()
+	taskOption.RestartPolicy = restartPolicy
+	return taskOption
+}
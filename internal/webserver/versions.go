@@ -0,0 +1,61 @@
+package webserver
+
+import (
+	"encoding/json"
+	"sort"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TerraformsGroup is the API group of the Terraform resource, the group of every version in
+// terraformVersions
+const TerraformsGroup = "tf.galleybytes.com"
+
+// terraformVersion converts a Terraform of a single API version to and from the v1beta1 Terraform that
+// plugins are applied to. Supporting a new API version only requires adding its conversion to
+// terraformVersions and registering its types to the runtimeScheme.
+type terraformVersion interface {
+	// decode returns the v1beta1 form of the raw Terraform
+	decode(raw []byte) (*tfv1beta1.Terraform, error)
+	// encode returns the Terraform in this API version
+	encode(tf *tfv1beta1.Terraform) ([]byte, error)
+}
+
+// terraformVersions are the API versions of the Terraform resource the webhook can mutate
+var terraformVersions = map[string]terraformVersion{
+	tfv1beta1.SchemeGroupVersion.Version: v1beta1Terraform{},
+}
+
+// SupportedVersions returns the sorted Terraform API versions the webhook can mutate
+func SupportedVersions() []string {
+	versions := []string{}
+	for version := range terraformVersions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// versionFor returns the conversion for the requested resource or nil if it is not supported
+func versionFor(resource metav1.GroupVersionResource) terraformVersion {
+	if resource != terraformsResource(resource.Version) {
+		return nil
+	}
+	return terraformVersions[resource.Version]
+}
+
+func terraformsResource(version string) metav1.GroupVersionResource {
+	return metav1.GroupVersionResource{Group: TerraformsGroup, Version: version, Resource: "terraforms"}
+}
+
+// v1beta1Terraform is the hub version so it does not need conversion
+type v1beta1Terraform struct{}
+
+func (v1beta1Terraform) decode(raw []byte) (*tfv1beta1.Terraform, error) {
+	return decodeTerraform(raw)
+}
+
+func (v1beta1Terraform) encode(tf *tfv1beta1.Terraform) ([]byte, error) {
+	return json.Marshal(tf)
+}
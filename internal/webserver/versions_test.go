@@ -0,0 +1,31 @@
+package webserver
+
+import (
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTerraformsGroup(t *testing.T) {
+	if TerraformsGroup != tfv1beta1.SchemeGroupVersion.Group {
+		t.Errorf("TerraformsGroup = %s, want the group of the v1beta1 types %s", TerraformsGroup, tfv1beta1.SchemeGroupVersion.Group)
+	}
+}
+
+func TestVersionFor(t *testing.T) {
+	tests := []struct {
+		resource metav1.GroupVersionResource
+		want     bool
+	}{
+		{resource: metav1.GroupVersionResource{Group: "tf.galleybytes.com", Version: "v1beta1", Resource: "terraforms"}, want: true},
+		{resource: metav1.GroupVersionResource{Group: "tf.galleybytes.com", Version: "v1alpha2", Resource: "terraforms"}, want: false},
+		{resource: metav1.GroupVersionResource{Group: "tf.galleybytes.com", Version: "v1beta1", Resource: "plugins"}, want: false},
+		{resource: metav1.GroupVersionResource{Group: "example.com", Version: "v1beta1", Resource: "terraforms"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := versionFor(tt.resource) != nil; got != tt.want {
+			t.Errorf("versionFor(%s) supported = %v, want %v", tt.resource.String(), got, tt.want)
+		}
+	}
+}
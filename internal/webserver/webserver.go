@@ -1,22 +1,34 @@
 package webserver
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"expvar"
 	"fmt"
-	"io/fs"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	jsonpatchapply "github.com/evanphx/json-patch"
 	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	"github.com/go-logr/logr"
+	"github.com/google/cel-go/cel"
 	"github.com/mattbaird/jsonpatch"
 	admission "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
@@ -24,8 +36,19 @@ var (
 	codecFactory  = serializer.NewCodecFactory(runtimeScheme)
 	deserializer  = codecFactory.UniversalDeserializer()
 	jsonPatchType = admission.PatchTypeJSONPatch
+	logger        = logr.Discard()
 )
 
+// SetLogger sets the logger of the webserver, nothing is logged until it is set
+func SetLogger(l logr.Logger) {
+	logger = l
+}
+
+// overrideAnnotationPrefix is the prefix of Terraform annotations that override plugin settings. The
+// full key is `<prefix><plugin>.<field>`, eg `plugin-manager.galleybytes.com/monitor.env.LOG_LEVEL`,
+// which is why plugin names can not contain dots.
+const overrideAnnotationPrefix = "plugin-manager.galleybytes.com/"
+
 // add kind AdmissionReview in scheme
 func init() {
 	_ = admission.AddToScheme(runtimeScheme)
@@ -36,15 +59,113 @@ type pluginOption struct {
 	SkipAnnotaiton string               `json:"skipAnnotation"`
 	PluginConfig   tfv1beta1.Plugin     `json:"pluginConfig"`
 	TaskOption     tfv1beta1.TaskOption `json:"taskConfig"`
+	// ExtraTaskOptions are added for the tasks in their `for` lists, eg env for `plan` and `apply`. See
+	// addExtraTaskOption for how they are merged with the Terraform's task options.
+	ExtraTaskOptions []tfv1beta1.TaskOption `json:"extraTaskConfigs"`
+	// Overrides is the allowlist of fields a Terraform can override via annotations. Entries are
+	// matched with path.Match, eg `env.LOG_LEVEL`, `env.*`, `labels.*`, `image`.
+	Overrides []string `json:"overrides"`
+	// Priority orders plugins that do not depend on each other. Higher priorities are applied later.
+	Priority int `json:"priority"`
+	// DependsOn lists the plugins that must be applied before this one. The plugin is skipped when any
+	// of its dependencies are skipped.
+	DependsOn []tfv1beta1.TaskName `json:"dependsOn"`
+	// NamespaceOptIn only applies the plugin in namespaces that enable it, see namespacePolicy
+	NamespaceOptIn bool `json:"namespaceOptIn"`
+	// Conditions limit the plugin to Terraforms whose spec matches, eg only those with an s3 backend
+	Conditions pluginConditions `json:"conditions"`
+	// Expression is a CEL expression that must be true for the plugin to be applied. It is evaluated
+	// with the submitted Terraform as `object` and the admission request as `request`, eg
+	// `request.operation == "CREATE" && object.metadata.namespace.startsWith("team-")`. Selecting a
+	// field the Terraform does not set is an evaluation error, which skips the plugin with a warning, so
+	// optional fields are checked with `has()` first, eg
+	// `has(object.spec.backend) && object.spec.backend.contains("s3")`.
+	Expression string `json:"expression"`
+	// MergePatch is a JSON merge patch (RFC 7386) and JSONPatch a JSON patch (RFC 6902) applied to the
+	// Terraform after every plugin and task option was added, eg to add a label. Neither may change a
+	// protected path. They are applied again on every update of the Terraform, so they must be
+	// idempotent, see decodeFragments.
+	MergePatch json.RawMessage `json:"mergePatch"`
+	JSONPatch  json.RawMessage `json:"jsonPatch"`
+	// SecretEnv lists the env vars, matched with path.Match, whose values are redacted in audit records
+	SecretEnv []string `json:"secretEnv"`
+
+	// name is the plugin name, taken from the plugin definition's filename
+	name tfv1beta1.TaskName
+	// hash identifies the content of the plugin definition in audit records
+	hash string
+	// program is the compiled Expression
+	program cel.Program
+	// jsonPatch is the decoded JSONPatch
+	jsonPatch jsonpatchapply.Patch
+	// namespaced is set for plugins defined in a namespace, see NamespacePluginPolicy
+	namespaced bool
+	// allowedRegistries restricts the images of plugins defined in namespaces, including overrides
+	allowedRegistries []string
+	// overridden are the fields applyOverrides changed, in order
+	overridden []string
 }
 
 type mutationHandler struct {
-	pluginMutationsFilepath string
-	resource                metav1.GroupVersionResource
+	plugins               *pluginStore
+	conflictPolicy        ConflictPolicy
+	events                *terraformEvents
+	audit                 *asyncAuditSink
+	namespaces            corelisters.NamespaceLister
+	namespacePlugins      corelisters.ConfigMapLister
+	namespacePluginPolicy NamespacePluginPolicy
+	images                ImagePolicy
+	protectedPaths        []string
+}
+
+// Config configures the webserver
+type Config struct {
+	// ServingCert is the key pair the server presents
+	ServingCert *ServingCert
+	// PluginMutationsFilepath is the directory of the cluster's plugin definitions. It is checked for
+	// changes every PluginReloadInterval and PluginLoadFailed is called when the changed definitions are
+	// not valid.
+	PluginMutationsFilepath string
+	PluginReloadInterval    time.Duration
+	PluginLoadFailed        func(error)
+	// MutatePath is the path mutations are served on, it must match the webhook's service path
+	MutatePath     string
+	ConflictPolicy ConflictPolicy
+	// Ready reports why the server should not receive admission requests, it is served on /readyz
+	Ready func() error
+	// ShutdownDelay is how long the server keeps serving, while reporting not ready, after the context
+	// is done so the API server stops sending requests before the server stops
+	ShutdownDelay time.Duration
+	// ShutdownTimeout is how long in-flight requests are given to finish
+	ShutdownTimeout time.Duration
+	// Recorder records events on the mutated Terraforms, which are looked up with the DynamicClient.
+	// No events are recorded when either is nil.
+	Recorder      record.EventRecorder
+	DynamicClient dynamic.Interface
+	// AuditSink receives a record of every admission response when it is set. Up to AuditBufferSize
+	// records wait to be written, later records are dropped until the sink catches up. The sink is
+	// drained for up to ShutdownTimeout and closed when the server stops.
+	AuditSink       AuditSink
+	AuditBufferSize int
+	// Namespaces is the cache namespaces' plugin labels and annotations are read from. Namespaces can
+	// not enable or disable plugins when it is nil.
+	Namespaces corelisters.NamespaceLister
+	// NamespacePlugins is the cache of ConfigMaps with the NamespacePluginsLabel. Namespaces can not
+	// define plugins when it is nil.
+	NamespacePlugins corelisters.ConfigMapLister
+	// NamespacePluginPolicy restricts the plugins namespaces define
+	NamespacePluginPolicy NamespacePluginPolicy
+	// ImagePolicy restricts the images of every plugin. The cluster's plugins fail to load when one of
+	// their images is denied.
+	ImagePolicy ImagePolicy
+	// ProtectedPaths are the Terraform fields plugin patches must not change, see DefaultProtectedPaths
+	ProtectedPaths []string
+	// MetricsAddr is the address metrics are served on over plain HTTP at /debug/vars. Metrics are not
+	// served when it is empty.
+	MetricsAddr string
 }
 
 func newPluginOption(dir, file string) (*pluginOption, error) {
-	var opt pluginOption
 	filename := filepath.Join(dir, file)
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -52,11 +173,36 @@ func newPluginOption(dir, file string) (*pluginOption, error) {
 		// return nilPatch()
 	}
 
-	err = json.Unmarshal(b, &opt)
+	opt, err := parsePluginOption(b)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing plugin data from file '%s'", filename)
+		return nil, fmt.Errorf("Error parsing plugin data from file '%s': %s", filename, err)
 	}
+	return opt, nil
+}
 
+// parsePluginOption parses a plugin definition
+func parsePluginOption(b []byte) (*pluginOption, error) {
+	var opt pluginOption
+	if err := json.Unmarshal(b, &opt); err != nil {
+		return nil, err
+	}
+	if err := opt.Conditions.validate(); err != nil {
+		return nil, err
+	}
+	if err := opt.validateExtraTaskOptions(); err != nil {
+		return nil, err
+	}
+	if err := opt.decodeFragments(); err != nil {
+		return nil, err
+	}
+	if opt.Expression != "" {
+		program, err := compileExpression(opt.Expression)
+		if err != nil {
+			return nil, err
+		}
+		opt.program = program
+	}
+	opt.hash = fmt.Sprintf("sha256:%x", sha256.Sum256(b))
 	return &opt, nil
 }
 
@@ -81,6 +227,95 @@ func (m mutationHandler) updatePlugins(tf *tfv1beta1.Terraform, pluginName tfv1b
 	return overwrites
 }
 
+// validatePluginName checks that the plugin name can be told apart from the field in override
+// annotations
+func validatePluginName(name tfv1beta1.TaskName) error {
+	if strings.Contains(string(name), ".") {
+		return fmt.Errorf("plugin name '%s' must not contain dots", name)
+	}
+	return nil
+}
+
+// allowsOverride checks the field against the plugin's override allowlist
+func (opt pluginOption) allowsOverride(field string) bool {
+	for _, pattern := range opt.Overrides {
+		if matched, _ := path.Match(pattern, field); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginOverrides returns the fields and values of the override annotations for the plugin
+func pluginOverrides(tf *tfv1beta1.Terraform, pluginName tfv1beta1.TaskName) map[string]string {
+	overrides := map[string]string{}
+	prefix := overrideAnnotationPrefix + string(pluginName) + "."
+	for key, value := range tf.ObjectMeta.Annotations {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		overrides[strings.TrimPrefix(key, prefix)] = value
+	}
+	return overrides
+}
+
+// applyOverrides applies the allowed overrides to the plugin option. The returned warnings describe
+// each override that was denied or not understood.
+func applyOverrides(log logr.Logger, images ImagePolicy, opt *pluginOption, pluginName tfv1beta1.TaskName, overrides map[string]string) []string {
+	warnings := []string{}
+	// The override task option carries the plugin's own scalar fields since mergeTaskOptions
+	// always takes those from the new task option
+	override := tfv1beta1.TaskOption{
+		Labels:        map[string]string{},
+		Annotations:   map[string]string{},
+		RestartPolicy: opt.TaskOption.RestartPolicy,
+		Resources:     opt.TaskOption.Resources,
+	}
+	opt.TaskOption.Script.DeepCopyInto(&override.Script)
+
+	// Overrides are applied in order so identical admissions get identical patches
+	for _, field := range sortedKeys(overrides) {
+		value := overrides[field]
+		if !opt.allowsOverride(field) {
+			warnings = append(warnings, fmt.Sprintf("plugin '%s' does not allow overriding '%s'", pluginName, field))
+			continue
+		}
+		kind, name, _ := strings.Cut(field, ".")
+		switch {
+		case field == "image":
+			if !imageFromRegistries(value, opt.allowedRegistries) {
+				warnings = append(warnings, fmt.Sprintf("plugin '%s' override image '%s' is not from an allowed registry", pluginName, value))
+				continue
+			}
+			image, imageWarnings, err := images.resolve(value)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("plugin '%s' override is denied by the image policy: %s", pluginName, err))
+				continue
+			}
+			for _, warning := range imageWarnings {
+				warnings = append(warnings, fmt.Sprintf("plugin '%s' override: %s", pluginName, warning))
+			}
+			opt.PluginConfig.Image = image
+		case field == "imagePullPolicy":
+			opt.PluginConfig.ImagePullPolicy = corev1.PullPolicy(value)
+		case kind == "env" && name != "":
+			override.Env = append(override.Env, corev1.EnvVar{Name: name, Value: value})
+		case kind == "labels" && name != "":
+			override.Labels[name] = value
+		case kind == "annotations" && name != "":
+			override.Annotations[name] = value
+		default:
+			warnings = append(warnings, fmt.Sprintf("plugin '%s' override '%s' is not a supported field", pluginName, field))
+			continue
+		}
+		log.Info("Overriding plugin field", "plugin", pluginName, "field", field)
+		opt.overridden = append(opt.overridden, field)
+	}
+
+	opt.TaskOption = mergeTaskOptions(opt.TaskOption, override)
+	return warnings
+}
+
 func doSkip(tf *tfv1beta1.Terraform, skipKey string) bool {
 	if tf.ObjectMeta.Annotations == nil {
 		tf.ObjectMeta.Annotations = make(map[string]string)
@@ -126,8 +361,12 @@ func mergeTaskOptions(oldTaskOption, newTaskOption tfv1beta1.TaskOption) tfv1bet
 		delete(envIndexMap, env.Name)
 
 	}
-	for _, i := range envIndexMap {
-		oldTaskOption.Env = append(oldTaskOption.Env, newTaskOption.Env[i])
+	// New env vars are appended in their own order so the result does not depend on map iteration
+	for _, env := range newTaskOption.Env {
+		if i, found := envIndexMap[env.Name]; found {
+			oldTaskOption.Env = append(oldTaskOption.Env, newTaskOption.Env[i])
+			delete(envIndexMap, env.Name)
+		}
 	}
 
 	for i, envFromSource := range oldTaskOption.EnvFrom {
@@ -137,12 +376,21 @@ func mergeTaskOptions(oldTaskOption, newTaskOption tfv1beta1.TaskOption) tfv1bet
 		oldTaskOption.EnvFrom[i] = newTaskOption.EnvFrom[envFromIndexMap[envFromSource]]
 		delete(envFromIndexMap, envFromSource)
 	}
-	for _, i := range envFromIndexMap {
-		oldTaskOption.EnvFrom = append(oldTaskOption.EnvFrom, newTaskOption.EnvFrom[i])
+	for _, envFromSource := range newTaskOption.EnvFrom {
+		if i, found := envFromIndexMap[envFromSource]; found {
+			oldTaskOption.EnvFrom = append(oldTaskOption.EnvFrom, newTaskOption.EnvFrom[i])
+			delete(envFromIndexMap, envFromSource)
+		}
 	}
 
 	// TODO policyRules
 
+	if oldTaskOption.Labels == nil && len(newTaskOption.Labels) > 0 {
+		oldTaskOption.Labels = map[string]string{}
+	}
+	if oldTaskOption.Annotations == nil && len(newTaskOption.Annotations) > 0 {
+		oldTaskOption.Annotations = map[string]string{}
+	}
 	for k, v := range newTaskOption.Labels {
 		oldTaskOption.Labels[k] = v
 	}
@@ -157,43 +405,188 @@ func mergeTaskOptions(oldTaskOption, newTaskOption tfv1beta1.TaskOption) tfv1bet
 	return oldTaskOption
 }
 
-func (m *mutationHandler) mutate(ar admission.AdmissionReview) *admission.AdmissionResponse {
-	if ar.Request.Resource != m.resource {
-		log.Printf("WARNING Expect resource to be %s", m.resource)
+func (m *mutationHandler) mutate(ar admission.AdmissionReview) (response *admission.AdmissionResponse) {
+	log := logger.WithValues(
+		"uid", ar.Request.UID,
+		"namespace", ar.Request.Namespace,
+		"name", ar.Request.Name,
+		"operation", ar.Request.Operation,
+	)
+	start := time.Now()
+	applied := []tfv1beta1.TaskName{}
+	merged := []tfv1beta1.TaskName{}
+	skipped := map[tfv1beta1.TaskName]bool{}
+	plugins := map[tfv1beta1.TaskName]string{}
+	var auditPatch []byte
+	defer func() {
+		log.Info("Reviewed admission request",
+			"allowed", response.Allowed,
+			"applied", applied,
+			"skipped", sortedTaskNames(skipped),
+			"patchSize", len(response.Patch),
+			"duration", time.Since(start).String(),
+		)
+		if m.audit == nil {
+			return
+		}
+		if auditPatch == nil {
+			auditPatch = response.Patch
+		}
+		record := AuditRecord{
+			Time:      start.UTC(),
+			UID:       ar.Request.UID,
+			Operation: ar.Request.Operation,
+			UserInfo:  ar.Request.UserInfo,
+			Object: AuditObjectRef{
+				Resource:  ar.Request.Resource,
+				Namespace: ar.Request.Namespace,
+				Name:      ar.Request.Name,
+			},
+			DryRun:   ar.Request.DryRun != nil && *ar.Request.DryRun,
+			Allowed:  response.Allowed,
+			Warnings: response.Warnings,
+			Applied:  applied,
+			Skipped:  sortedTaskNames(skipped),
+			Plugins:  plugins,
+			Patch:    auditPatch,
+		}
+		if response.Result != nil {
+			record.Message = response.Result.Message
+		}
+		m.audit.add(record)
+	}()
+
+	version := versionFor(ar.Request.Resource)
+	if version == nil {
+		log.Info("Unexpected resource", "resource", ar.Request.Resource.String(), "expected", fmt.Sprintf("terraforms.%s of version %s", TerraformsGroup, strings.Join(SupportedVersions(), ", ")))
 		return nilPatch()
 	}
 	objectJSON := ar.Request.Object.Raw
-	terraform, err := decodeTerraform(objectJSON)
+	terraform, err := version.decode(objectJSON)
 	if err != nil {
-		log.Println(err)
+		log.Error(err, "Failed to decode the terraform")
 		return &admission.AdmissionResponse{Result: &metav1.Status{Message: err.Error()}}
 	}
 
-	for _, file := range ls(m.pluginMutationsFilepath) {
-		if file.IsDir() {
+	warnings := []string{}
+	injected := readInjectedRecord(terraform)
+	// The cluster's plugins were validated, sorted and had their conflicts resolved when they were loaded
+	set := m.plugins.get()
+	opts := set.options()
+	secrets := append(secretEnv{}, set.secrets...)
+	for _, conflict := range set.conflicts {
+		skipped[conflict.loser] = true
+		warnings = append(warnings, conflict.String())
+	}
+
+	// Namespaces layer their own plugins on top of the cluster's, they are ordered and had their
+	// conflicts resolved against the cluster's plugins
+	namespaceOpts, namespaceWarnings, err := m.namespacePluginOptions(ar.Request.Namespace, opts)
+	if err != nil {
+		log.Error(err, "Failed to load namespace plugins")
+		warnings = append(warnings, fmt.Sprintf("namespace plugins are not applied: %s", err))
+	}
+	warnings = append(warnings, namespaceWarnings...)
+	for _, opt := range namespaceOpts {
+		secrets = append(secrets, opt.SecretEnv...)
+	}
+	opts = append(opts, namespaceOpts...)
+
+	namespace, err := m.namespacePolicy(ar.Request.Namespace)
+	if err != nil {
+		// Fall back to the plugins' defaults rather than failing the request
+		log.Error(err, "Failed to read the namespace's plugin settings")
+		namespace = namespacePolicy{}
+	}
+	warnings = append(warnings, namespace.warnings()...)
+
+	for _, opt := range opts {
+		plugins[opt.name] = opt.hash
+	}
+
+	// Conditions and expressions see the Terraform as it was submitted, without what the manager injected
+	submitted := injected.submitted(terraform, opts)
+	vars, err := expressionVars(ar, submitted)
+	if err != nil {
+		log.Error(err, "Failed to decode the terraform")
+		return &admission.AdmissionResponse{Result: &metav1.Status{Message: err.Error()}}
+	}
+
+	appliedOpts := []*pluginOption{}
+	// The task options the manager added for extra task configs, by index
+	owned := injected.ownedTaskOptions(terraform)
+	for _, opt := range opts {
+		pluginName := opt.name
+		log.V(1).Info("Checking plugin", "plugin", pluginName)
+
+		// Every plugin config has the option to not mutate if the resource contains the escape key
+		if doSkip(terraform, opt.SkipAnnotaiton) {
+			skipped[pluginName] = true
 			continue
 		}
-		filename := file.Name()
-		if strings.HasPrefix(filename, ".") {
+
+		// Plugins only apply to the Terraforms their conditions match
+		if matched, reason := opt.Conditions.match(submitted); !matched {
+			log.V(1).Info("Skipping plugin whose conditions do not match", "plugin", pluginName, "reason", reason)
+			skipped[pluginName] = true
 			continue
 		}
-		log.Println(filename)
 
-		pluginName := tfv1beta1.TaskName(filename)
+		// Plugins only apply where their expression is true
+		if apply, err := opt.evaluate(vars); err != nil || !apply {
+			if err != nil {
+				log.Error(err, "Skipping plugin whose expression failed", "plugin", pluginName)
+				warnings = append(warnings, fmt.Sprintf("plugin '%s' is not applied: %s", pluginName, err))
+			} else {
+				log.V(1).Info("Skipping plugin whose expression is false", "plugin", pluginName)
+			}
+			skipped[pluginName] = true
+			continue
+		}
 
-		opt, err := newPluginOption(m.pluginMutationsFilepath, filename)
-		if err != nil {
-			return nilPatch()
+		// Namespace owners choose which plugins apply to the namespace
+		if enabled, reason := namespace.enables(opt); !enabled {
+			log.V(1).Info("Skipping plugin", "plugin", pluginName, "reason", reason)
+			skipped[pluginName] = true
+			continue
 		}
 
-		// Every plugin config has the option to not mutate if the resource contains the escape key
-		if doSkip(terraform, opt.SkipAnnotaiton) {
+		// Plugins are not applied without the plugins they depend on
+		if dependency := opt.skippedDependency(skipped); dependency != "" {
+			log.Info("Skipping plugin because its dependency was skipped", "plugin", pluginName, "dependency", dependency)
+			skipped[pluginName] = true
 			continue
 		}
 
+		// Terraforms may override the fields the plugin allows via annotations
+		warnings = append(warnings, applyOverrides(log, m.images, opt, pluginName, pluginOverrides(terraform, pluginName))...)
+
+		// The user may have defined a plugin with the same name
+		if userPluginConflict(terraform, opt, injected) {
+			countPluginConflict("admission", m.conflictPolicy)
+			msg := fmt.Sprintf("plugin '%s' conflicts with the user-defined plugin of the same name", pluginName)
+			switch {
+			case m.conflictPolicy == ConflictPolicyError && !opt.namespaced:
+				log.Info("Denied by a plugin conflict", "plugin", pluginName, "policy", m.conflictPolicy)
+				return &admission.AdmissionResponse{Result: &metav1.Status{Message: msg}}
+			case m.conflictPolicy == ConflictPolicyError, m.conflictPolicy == ConflictPolicyFirstWins:
+				// A namespace plugin never denies the Terraforms of its namespace, it is skipped instead
+				msg += fmt.Sprintf(", '%s' is not applied", pluginName)
+				log.Info("Skipping plugin that conflicts with a user-defined plugin", "plugin", pluginName, "policy", m.conflictPolicy)
+				warnings = append(warnings, msg)
+				skipped[pluginName] = true
+				continue
+			default:
+				msg += ", the user-defined plugin is overwritten"
+				warnings = append(warnings, msg)
+			}
+		}
+
 		if m.updatePlugins(terraform, pluginName, opt.PluginConfig) {
-			log.Printf("Overwriting existing '%s' plugin", pluginName)
+			log.Info("Overwriting existing plugin", "plugin", pluginName)
 		}
+		applied = append(applied, pluginName)
+		appliedOpts = append(appliedOpts, opt)
 
 		if terraform.Spec.TaskOptions == nil {
 			terraform.Spec.TaskOptions = []tfv1beta1.TaskOption{}
@@ -201,8 +594,11 @@ func (m *mutationHandler) mutate(ar admission.AdmissionReview) *admission.Admiss
 
 		taskOptionIndex := findTaskOptionIndex(terraform, pluginName)
 		if taskOptionIndex > -1 {
+			// What overrides added before is removed once their annotations are removed
+			terraform.Spec.TaskOptions[taskOptionIndex], _ = withoutFields(terraform.Spec.TaskOptions[taskOptionIndex], injected.staleOverrides(opt))
 			// Special consideration for mutating here becuase there are arrays of complex objects to take into account
 			terraform.Spec.TaskOptions[taskOptionIndex] = mergeTaskOptions(terraform.Spec.TaskOptions[taskOptionIndex], opt.TaskOption)
+			merged = append(merged, pluginName)
 			// opt.TaskOption.DeepCopyInto(&)
 		} else {
 			terraform.Spec.TaskOptions = append(terraform.Spec.TaskOptions, opt.TaskOption)
@@ -214,11 +610,39 @@ func (m *mutationHandler) mutate(ar admission.AdmissionReview) *admission.Admiss
 			terraform.Spec.TaskOptions[taskOptionIndex].RestartPolicy = corev1.RestartPolicyAlways
 		}
 
+		for _, extra := range opt.ExtraTaskOptions {
+			log.V(1).Info("Adding plugin task option", "plugin", pluginName, "for", joinTaskNames(extra.For))
+			warnings = append(warnings, addExtraTaskOption(terraform, pluginName, extra, owned)...)
+		}
+
 		_ = corev1.Pod{}
 
 	}
 
-	targetJson, err := json.Marshal(terraform)
+	// Plugin patches go last so they see, and may adjust, what every plugin added. A patch that adds or
+	// removes task options moves the ones the manager owns, they are found again by their content.
+	beforePatches := injectedRecord{}
+	beforePatches.update(terraform, nil, owned)
+	taskOptionCount := len(terraform.Spec.TaskOptions)
+	for _, opt := range appliedOpts {
+		patched, err := opt.applyFragments(terraform, m.protectedPaths)
+		if err != nil {
+			log.Error(err, "Skipping plugin patch", "plugin", opt.name)
+			warnings = append(warnings, fmt.Sprintf("plugin '%s' patch is not applied: %s", opt.name, err))
+			continue
+		}
+		terraform = patched
+	}
+
+	if len(terraform.Spec.TaskOptions) != taskOptionCount {
+		owned = beforePatches.ownedTaskOptions(terraform)
+	}
+	injected.update(terraform, appliedOpts, owned)
+	if err := injected.write(terraform); err != nil {
+		log.Error(err, "Failed to record the injected plugins")
+	}
+
+	targetJson, err := version.encode(terraform)
 	if err != nil {
 		return &admission.AdmissionResponse{
 			Result: &metav1.Status{
@@ -242,12 +666,13 @@ func (m *mutationHandler) mutate(ar admission.AdmissionReview) *admission.Admiss
 			continue
 		}
 		realPatch = append(realPatch, p)
-		log.Println(p)
+		log.V(1).Info("Patch operation", "op", p.Operation, "path", p.Path)
 	}
 
 	if len(realPatch) == 0 {
-		log.Println("No patches to do")
-		return nilPatch()
+		response := nilPatch()
+		response.Warnings = warnings
+		return response
 	}
 
 	patchJSON, err := json.Marshal(realPatch)
@@ -258,15 +683,16 @@ func (m *mutationHandler) mutate(ar admission.AdmissionReview) *admission.Admiss
 			},
 		}
 	}
-	return &admission.AdmissionResponse{Allowed: true, PatchType: &jsonPatchType, Patch: patchJSON}
-}
-
-func ls(dir string) []fs.FileInfo {
-	b, err := ioutil.ReadDir(dir)
-	if err != nil {
-		log.Panic(err)
+	if m.audit != nil {
+		auditPatch, err = redactPatch(realPatch, targetJson, secrets)
+		if err != nil {
+			// Never audit secret values, the patch is left out when it can not be redacted
+			log.Error(err, "Failed to redact the patch for the audit record")
+			auditPatch = []byte("null")
+		}
 	}
-	return b
+	m.events.pluginsInjected(ar, applied, merged)
+	return &admission.AdmissionResponse{Allowed: true, PatchType: &jsonPatchType, Patch: patchJSON, Warnings: warnings}
 }
 
 func decodeTerraform(raw []byte) (*tfv1beta1.Terraform, error) {
@@ -290,7 +716,7 @@ func admissionHandler(w http.ResponseWriter, r *http.Request, admissionFunc func
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		log.Printf("contentType=%s, expect application/json", contentType)
+		logger.Info("Unexpected content type, expect application/json", "contentType", contentType)
 		return
 	}
 
@@ -298,14 +724,14 @@ func admissionHandler(w http.ResponseWriter, r *http.Request, admissionFunc func
 	obj, gvk, err := deserializer.Decode(body, nil, nil)
 	if err != nil {
 		msg := fmt.Sprintf("Request could not be decoded: %v", err)
-		log.Println(msg)
+		logger.Error(err, "Request could not be decoded")
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
 	requestedAdmissionReview, ok := obj.(*admission.AdmissionReview)
 	if !ok {
-		log.Printf("Expected v1.AdmissionReview but got: %T", obj)
+		logger.Info("Expected v1.AdmissionReview", "type", fmt.Sprintf("%T", obj))
 		return
 	}
 
@@ -317,37 +743,128 @@ func admissionHandler(w http.ResponseWriter, r *http.Request, admissionFunc func
 
 	respBytes, err := json.Marshal(responseObj)
 	if err != nil {
-		log.Println(err)
+		logger.Error(err, "Failed to encode the admission response")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(respBytes); err != nil {
-		log.Println(err)
+		logger.Error(err, "Failed to write the admission response")
 	}
 }
 
+// sortedTaskNames returns the names in the set in order
+func sortedTaskNames(names map[tfv1beta1.TaskName]bool) []tfv1beta1.TaskName {
+	sorted := make([]tfv1beta1.TaskName, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
 // Return an empty patch to satisfy the response
 func nilPatch() *admission.AdmissionResponse {
 	return &admission.AdmissionResponse{Allowed: true, PatchType: &jsonPatchType, Patch: []byte("[]")}
 }
 
-func terraformsResource() metav1.GroupVersionResource {
-	group := tfv1beta1.SchemeGroupVersion.Group
-	version := tfv1beta1.SchemeGroupVersion.Version
-	return metav1.GroupVersionResource{Group: group, Version: version, Resource: "terraforms"}
-}
+// Run starts the webserver and blocks until the context is done and in-flight requests are drained
+func Run(ctx context.Context, config Config) error {
+	var shuttingDown atomic.Bool
+	plugins, err := newPluginStore(config.PluginMutationsFilepath, config.ConflictPolicy, config.ImagePolicy, config.PluginLoadFailed)
+	if err != nil {
+		return err
+	}
+	go plugins.run(ctx, config.PluginReloadInterval)
 
-// Run starts the webserver and blocks
-func Run(tlsCertFilename, tlsKeyFilename, pluginMutationsFilepath string) {
 	server := http.NewServeMux()
-	server.Handle("/mutate", mutationHandler{
-		pluginMutationsFilepath: pluginMutationsFilepath,
-		resource:                terraformsResource(),
+	handler := mutationHandler{
+		plugins:               plugins,
+		conflictPolicy:        config.ConflictPolicy,
+		namespaces:            config.Namespaces,
+		namespacePlugins:      config.NamespacePlugins,
+		namespacePluginPolicy: config.NamespacePluginPolicy,
+		images:                config.ImagePolicy,
+		protectedPaths:        config.ProtectedPaths,
+	}
+	if config.AuditSink != nil {
+		handler.audit = newAsyncAuditSink(config.AuditSink, config.AuditBufferSize)
+		defer func() {
+			// The server is stopped, so the buffered records are the last ones
+			ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+			defer cancel()
+			if err := handler.audit.close(ctx); err != nil {
+				logger.Error(err, "Failed to close the audit sink")
+			}
+		}()
+	}
+	if config.Recorder != nil && config.DynamicClient != nil {
+		handler.events = newTerraformEvents(config.DynamicClient, config.Recorder)
+		go handler.events.run(ctx)
+	}
+	server.Handle(config.MutatePath, handler)
+	server.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if config.Ready != nil {
+			if err := config.Ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
 	})
 
-	log.Printf("Server started ...")
-	err := http.ListenAndServeTLS(":8443", tlsCertFilename, tlsKeyFilename, server)
-	log.Fatal(err)
+	httpServer := &http.Server{
+		Addr:    ":8443",
+		Handler: server,
+		TLSConfig: &tls.Config{
+			GetCertificate: config.ServingCert.GetCertificate,
+		},
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		logger.Info("Server started", "addr", httpServer.Addr)
+		errCh <- httpServer.ListenAndServeTLS("", "")
+	}()
+
+	// Metrics are kept off the webhook's listener, which every client of the service can reach
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		metrics := http.NewServeMux()
+		metrics.Handle("/debug/vars", expvar.Handler())
+		metricsServer = &http.Server{Addr: config.MetricsAddr, Handler: metrics}
+		go func() {
+			logger.Info("Metrics server started", "addr", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				errCh <- err
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	logger.Info("Shutting down", "delay", config.ShutdownDelay.String())
+	time.Sleep(config.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error(err, "Failed to stop the metrics server")
+		}
+	}
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	logger.Info("Server stopped")
+	return nil
 }
@@ -0,0 +1,532 @@
+package webserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatchapply "github.com/evanphx/json-patch"
+	tfv1beta1 "github.com/galleybytes/terraform-operator/pkg/apis/tf/v1beta1"
+	"github.com/go-logr/logr"
+	admission "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// mustParsePluginOption parses a plugin definition for a test and names it
+func mustParsePluginOption(t *testing.T, name tfv1beta1.TaskName, definition string) *pluginOption {
+	t.Helper()
+	opt, err := parsePluginOption([]byte(definition))
+	if err != nil {
+		t.Fatalf("failed to parse plugin '%s': %s", name, err)
+	}
+	opt.name = name
+	return opt
+}
+
+func TestApplyOverrides(t *testing.T) {
+	definition := `{
+		"overrides": ["env.*", "labels.team", "image"],
+		"pluginConfig": {"image": "ghcr.io/galleybytes/monitor:0.1.3", "when": "After", "task": "apply"},
+		"taskConfig": {"env": [{"name": "LOG_LEVEL", "value": "info"}], "restartPolicy": "Never"}
+	}`
+
+	tests := []struct {
+		name              string
+		allowedRegistries []string
+		images            ImagePolicy
+		overrides         map[string]string
+		wantImage         string
+		wantEnv           []corev1.EnvVar
+		wantLabels        map[string]string
+		wantWarnings      []string
+	}{
+		{
+			name:      "no overrides",
+			wantImage: "ghcr.io/galleybytes/monitor:0.1.3",
+			wantEnv:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+		},
+		{
+			name: "env is replaced in place and new env is appended in order",
+			overrides: map[string]string{
+				"env.ZONE":      "b",
+				"env.LOG_LEVEL": "debug",
+				"env.REGION":    "a",
+				"env.CLUSTER":   "c",
+			},
+			wantImage: "ghcr.io/galleybytes/monitor:0.1.3",
+			wantEnv: []corev1.EnvVar{
+				{Name: "LOG_LEVEL", Value: "debug"},
+				{Name: "CLUSTER", Value: "c"},
+				{Name: "REGION", Value: "a"},
+				{Name: "ZONE", Value: "b"},
+			},
+		},
+		{
+			name:       "labels",
+			overrides:  map[string]string{"labels.team": "platform"},
+			wantImage:  "ghcr.io/galleybytes/monitor:0.1.3",
+			wantEnv:    []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+			wantLabels: map[string]string{"team": "platform"},
+		},
+		{
+			name:      "fields that are not allowed or not supported are warned about",
+			overrides: map[string]string{"labels.owner": "me", "imagePullPolicy": "Always"},
+			wantImage: "ghcr.io/galleybytes/monitor:0.1.3",
+			wantEnv:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+			wantWarnings: []string{
+				"plugin 'monitor' does not allow overriding 'imagePullPolicy'",
+				"plugin 'monitor' does not allow overriding 'labels.owner'",
+			},
+		},
+		{
+			name:      "image",
+			overrides: map[string]string{"image": "ghcr.io/galleybytes/monitor:0.2.0"},
+			wantImage: "ghcr.io/galleybytes/monitor:0.2.0",
+			wantEnv:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+		},
+		{
+			name:      "image is pinned by the image policy",
+			images:    ImagePolicy{Digests: map[string]string{"ghcr.io/galleybytes/monitor:0.2.0": "sha256:abc"}},
+			overrides: map[string]string{"image": "ghcr.io/galleybytes/monitor:0.2.0"},
+			wantImage: "ghcr.io/galleybytes/monitor:0.2.0@sha256:abc",
+			wantEnv:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+		},
+		{
+			name:         "image denied by the image policy",
+			images:       ImagePolicy{AllowedRegistries: []string{"ghcr.io/galleybytes"}},
+			overrides:    map[string]string{"image": "docker.io/monitor:0.2.0"},
+			wantImage:    "ghcr.io/galleybytes/monitor:0.1.3",
+			wantEnv:      []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+			wantWarnings: []string{"plugin 'monitor' override is denied by the image policy: image 'docker.io/monitor:0.2.0' is not from an allowed registry"},
+		},
+		{
+			name:              "image of a namespace plugin outside its registries",
+			allowedRegistries: []string{"ghcr.io/galleybytes"},
+			overrides:         map[string]string{"image": "quay.io/monitor:0.2.0"},
+			wantImage:         "ghcr.io/galleybytes/monitor:0.1.3",
+			wantEnv:           []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+			wantWarnings:      []string{"plugin 'monitor' override image 'quay.io/monitor:0.2.0' is not from an allowed registry"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := mustParsePluginOption(t, "monitor", definition)
+			opt.allowedRegistries = tt.allowedRegistries
+			warnings := applyOverrides(logr.Discard(), tt.images, opt, opt.name, tt.overrides)
+
+			if opt.PluginConfig.Image != tt.wantImage {
+				t.Errorf("image = %s, want %s", opt.PluginConfig.Image, tt.wantImage)
+			}
+			if !reflect.DeepEqual(opt.TaskOption.Env, tt.wantEnv) {
+				t.Errorf("env = %v, want %v", opt.TaskOption.Env, tt.wantEnv)
+			}
+			if len(opt.TaskOption.Labels) > 0 || len(tt.wantLabels) > 0 {
+				if !reflect.DeepEqual(opt.TaskOption.Labels, tt.wantLabels) {
+					t.Errorf("labels = %v, want %v", opt.TaskOption.Labels, tt.wantLabels)
+				}
+			}
+			if opt.TaskOption.RestartPolicy != corev1.RestartPolicyNever {
+				t.Errorf("restartPolicy = %s, want the plugin's %s", opt.TaskOption.RestartPolicy, corev1.RestartPolicyNever)
+			}
+			if len(warnings) > 0 || len(tt.wantWarnings) > 0 {
+				if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+					t.Errorf("warnings = %q, want %q", warnings, tt.wantWarnings)
+				}
+			}
+		})
+	}
+}
+
+func TestPluginOverrides(t *testing.T) {
+	tf := &tfv1beta1.Terraform{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		"plugin-manager.galleybytes.com/monitor.env.LOG_LEVEL":    "debug",
+		"plugin-manager.galleybytes.com/monitor.labels.team":      "platform",
+		"plugin-manager.galleybytes.com/monitoring.env.LOG_LEVEL": "info",
+		"plugin-manager.galleybytes.com/plugins":                  "disabled",
+		"example.com/monitor.env.LOG_LEVEL":                       "warn",
+	}}}
+	want := map[string]string{"env.LOG_LEVEL": "debug", "labels.team": "platform"}
+	if got := pluginOverrides(tf, "monitor"); !reflect.DeepEqual(got, want) {
+		t.Errorf("pluginOverrides() = %v, want %v", got, want)
+	}
+}
+
+func TestValidatePluginName(t *testing.T) {
+	for name, wantErr := range map[tfv1beta1.TaskName]bool{
+		"monitor":         false,
+		"cost-estimation": false,
+		"monitor.v2":      true,
+	} {
+		if err := validatePluginName(name); (err != nil) != wantErr {
+			t.Errorf("validatePluginName(%s) error = %v, want error %v", name, err, wantErr)
+		}
+	}
+}
+
+// testMutationHandler returns a mutation handler for the plugin definitions, by file name
+func testMutationHandler(t *testing.T, policy ConflictPolicy, plugins map[string]string) *mutationHandler {
+	t.Helper()
+	dir := t.TempDir()
+	for name, definition := range plugins {
+		writePlugin(t, dir, name, definition)
+	}
+	store, err := newPluginStore(dir, policy, DefaultImagePolicy(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mutationHandler{
+		plugins:        store,
+		conflictPolicy: policy,
+		images:         DefaultImagePolicy(),
+		protectedPaths: DefaultProtectedPaths,
+	}
+}
+
+// testMutate admits the Terraform and returns the response and the Terraform with the patch applied
+func testMutate(t *testing.T, m *mutationHandler, operation admission.Operation, tf *tfv1beta1.Terraform) (*admission.AdmissionResponse, *tfv1beta1.Terraform) {
+	t.Helper()
+	tf = tf.DeepCopy()
+	tf.TypeMeta = metav1.TypeMeta{APIVersion: tfv1beta1.SchemeGroupVersion.String(), Kind: "Terraform"}
+	raw, err := json.Marshal(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := admission.AdmissionReview{Request: &admission.AdmissionRequest{
+		UID:       "test",
+		Namespace: tf.Namespace,
+		Name:      tf.Name,
+		Operation: operation,
+		Resource:  terraformsResource(tfv1beta1.SchemeGroupVersion.Version),
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+	response := m.mutate(ar)
+	if !response.Allowed {
+		return response, nil
+	}
+	patch, err := jsonpatchapply.DecodePatch(response.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutated, err := decodeTerraform(patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, mutated
+}
+
+func TestMutateKeepsUserTaskOptionsOnUpdate(t *testing.T) {
+	m := testMutationHandler(t, ConflictPolicyPriorityWins, map[string]string{
+		"monitor": `{
+			"pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"},
+			"extraTaskConfigs": [{"for": ["plan", "apply"], "env": [{"name": "REGION", "value": "a"}], "restartPolicy": "OnFailure"}]
+		}`,
+	})
+	user := tfv1beta1.TaskOption{
+		For:           []tfv1beta1.TaskName{"plan", "apply"},
+		Env:           []corev1.EnvVar{{Name: "ZONE", Value: "user"}},
+		RestartPolicy: corev1.RestartPolicyNever,
+	}
+	tf := &tfv1beta1.Terraform{ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: "default"}}
+	tf.Spec.TaskOptions = []tfv1beta1.TaskOption{user}
+
+	_, created := testMutate(t, m, admission.Create, tf)
+	if created == nil {
+		t.Fatal("the Terraform was not admitted")
+	}
+	if len(created.Spec.TaskOptions) != 3 {
+		t.Fatalf("task options = %+v, want the user's, the plugin's and the extra task option", created.Spec.TaskOptions)
+	}
+
+	// The user's task option is for the same tasks as the extra task option but is never merged into
+	response, updated := testMutate(t, m, admission.Update, created)
+	if updated == nil {
+		t.Fatal("the Terraform was not admitted")
+	}
+	if string(response.Patch) != "[]" {
+		t.Errorf("patch = %s, want no changes", response.Patch)
+	}
+	if !reflect.DeepEqual(updated.Spec.TaskOptions[0], user) {
+		t.Errorf("user task option = %+v, want %+v", updated.Spec.TaskOptions[0], user)
+	}
+	if !reflect.DeepEqual(updated.Spec.TaskOptions, created.Spec.TaskOptions) {
+		t.Errorf("task options = %+v, want %+v", updated.Spec.TaskOptions, created.Spec.TaskOptions)
+	}
+
+	// The user's task options count as configured tasks for plugin conditions
+	submitted := readInjectedRecord(updated).submitted(updated, m.plugins.get().options())
+	if !reflect.DeepEqual(submitted.Spec.TaskOptions, []tfv1beta1.TaskOption{user}) {
+		t.Errorf("submitted task options = %+v, want %+v", submitted.Spec.TaskOptions, []tfv1beta1.TaskOption{user})
+	}
+}
+
+func TestMutateWarnsAboutPluginConflicts(t *testing.T) {
+	m := testMutationHandler(t, ConflictPolicyPriorityWins, map[string]string{
+		"bboxtest":   `{"priority": 1, "pluginConfig": {"image": "busybox:1.36", "when": "At", "task": "init"}}`,
+		"ubuntutest": `{"pluginConfig": {"image": "ubuntu:22.04", "when": "At", "task": "init"}}`,
+	})
+	tf := &tfv1beta1.Terraform{ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: "default"}}
+	response, mutated := testMutate(t, m, admission.Create, tf)
+	if mutated == nil {
+		t.Fatal("the Terraform was not admitted")
+	}
+	if _, found := mutated.Spec.Plugins["ubuntutest"]; found {
+		t.Error("the plugin that lost the conflict was applied")
+	}
+	want := []string{"plugin 'ubuntutest' conflicts with 'bboxtest' (both run At init), 'ubuntutest' is not applied"}
+	if !reflect.DeepEqual(response.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", response.Warnings, want)
+	}
+}
+
+func TestMutateRemovesStaleOverrides(t *testing.T) {
+	m := testMutationHandler(t, ConflictPolicyPriorityWins, map[string]string{
+		"monitor": `{
+			"overrides": ["env.*", "labels.*"],
+			"pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"},
+			"taskConfig": {"env": [{"name": "LOG_LEVEL", "value": "info"}]}
+		}`,
+	})
+	tf := &tfv1beta1.Terraform{ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: "default", Annotations: map[string]string{
+		"plugin-manager.galleybytes.com/monitor.env.LOG_LEVEL": "debug",
+		"plugin-manager.galleybytes.com/monitor.env.REGION":    "a",
+		"plugin-manager.galleybytes.com/monitor.labels.team":   "platform",
+	}}}
+	_, created := testMutate(t, m, admission.Create, tf)
+	if created == nil {
+		t.Fatal("the Terraform was not admitted")
+	}
+	want := []string{"env.LOG_LEVEL", "env.REGION", "labels.team"}
+	if got := readInjectedRecord(created).Overrides["monitor"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded overrides = %v, want %v", got, want)
+	}
+
+	// Removing the annotations removes what they added and restores what they replaced
+	delete(created.Annotations, "plugin-manager.galleybytes.com/monitor.env.LOG_LEVEL")
+	delete(created.Annotations, "plugin-manager.galleybytes.com/monitor.labels.team")
+	_, updated := testMutate(t, m, admission.Update, created)
+	if updated == nil {
+		t.Fatal("the Terraform was not admitted")
+	}
+	taskOption := updated.Spec.TaskOptions[findTaskOptionIndex(updated, "monitor")]
+	wantEnv := []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}, {Name: "REGION", Value: "a"}}
+	if !reflect.DeepEqual(taskOption.Env, wantEnv) {
+		t.Errorf("env = %v, want %v", taskOption.Env, wantEnv)
+	}
+	if _, found := taskOption.Labels["team"]; found {
+		t.Error("the label of the removed override was kept")
+	}
+	want = []string{"env.REGION"}
+	if got := readInjectedRecord(updated).Overrides["monitor"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded overrides = %v, want %v", got, want)
+	}
+}
+
+// mutateResult is what an admission did to a Terraform
+type mutateResult struct {
+	// denied is the message of a denied admission
+	denied string
+	// plugins are the Terraform's plugins and injected the ones the manager recorded as injected
+	plugins  []tfv1beta1.TaskName
+	injected []tfv1beta1.TaskName
+	warnings []string
+}
+
+func TestMutate(t *testing.T) {
+	monitor := `{"pluginConfig": {"image": "busybox:1.36", "when": "After", "task": "apply"}}`
+	userMonitor := tfv1beta1.Plugin{When: "After", Task: "apply"}
+	userMonitor.Image = "example.com/monitor:1.0"
+
+	tests := []struct {
+		name      string
+		policy    ConflictPolicy
+		plugins   map[string]string
+		namespace corev1.Namespace
+		// namespacePlugins are the plugin definitions of the Terraform's namespace
+		namespacePlugins map[string]string
+		tf               tfv1beta1.Terraform
+		// change is made to the created Terraform before it is updated
+		change func(tf *tfv1beta1.Terraform)
+		create mutateResult
+		update mutateResult
+		// unchanged means the update needs no patch
+		unchanged bool
+		check     func(t *testing.T, created, updated *tfv1beta1.Terraform)
+	}{
+		{
+			name:      "plugins are injected and recorded",
+			plugins:   map[string]string{"monitor": monitor},
+			create:    mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+			update:    mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+			unchanged: true,
+		},
+		{
+			name:    "namespace disables a plugin",
+			plugins: map[string]string{"monitor": monitor, "setup": `{"pluginConfig": {"image": "busybox:1.36", "when": "Before", "task": "init"}}`},
+			namespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				"plugin-manager.galleybytes.com/plugin.monitor": "disabled",
+			}}},
+			create:    mutateResult{plugins: tasks("setup"), injected: tasks("setup")},
+			update:    mutateResult{plugins: tasks("setup"), injected: tasks("setup")},
+			unchanged: true,
+		},
+		{
+			name:    "namespace enables an opt-in plugin",
+			plugins: map[string]string{"monitor": strings.Replace(monitor, "{", `{"namespaceOptIn": true, `, 1)},
+			namespace: corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+				"plugin-manager.galleybytes.com/plugins": "enabled",
+			}}},
+			create:    mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+			update:    mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+			unchanged: true,
+		},
+		{
+			name:             "namespace plugins are layered on the cluster's",
+			plugins:          map[string]string{"monitor": monitor},
+			namespacePlugins: map[string]string{"lint": `{"dependsOn": ["monitor"], "pluginConfig": {"image": "ghcr.io/team-a/lint:1.0", "when": "Before", "task": "plan"}}`},
+			create:           mutateResult{plugins: tasks("lint", "monitor"), injected: tasks("lint", "monitor")},
+			update:           mutateResult{plugins: tasks("lint", "monitor"), injected: tasks("lint", "monitor")},
+			unchanged:        true,
+		},
+		{
+			name:    "error policy denies a conflict with a user-defined plugin",
+			policy:  ConflictPolicyError,
+			plugins: map[string]string{"monitor": monitor},
+			tf:      tfv1beta1.Terraform{Spec: tfv1beta1.TerraformSpec{Plugins: map[tfv1beta1.TaskName]tfv1beta1.Plugin{"monitor": userMonitor}}},
+			create:  mutateResult{denied: "plugin 'monitor' conflicts with the user-defined plugin of the same name"},
+		},
+		{
+			name:      "first-wins policy keeps a user-defined plugin",
+			policy:    ConflictPolicyFirstWins,
+			plugins:   map[string]string{"monitor": monitor},
+			tf:        tfv1beta1.Terraform{Spec: tfv1beta1.TerraformSpec{Plugins: map[tfv1beta1.TaskName]tfv1beta1.Plugin{"monitor": userMonitor}}},
+			create:    mutateResult{plugins: tasks("monitor"), warnings: []string{"plugin 'monitor' conflicts with the user-defined plugin of the same name, 'monitor' is not applied"}},
+			update:    mutateResult{plugins: tasks("monitor"), warnings: []string{"plugin 'monitor' conflicts with the user-defined plugin of the same name, 'monitor' is not applied"}},
+			unchanged: true,
+		},
+		{
+			name:    "a changed injected plugin is the user's",
+			plugins: map[string]string{"monitor": monitor},
+			change: func(tf *tfv1beta1.Terraform) {
+				tf.Spec.Plugins["monitor"] = userMonitor
+			},
+			create: mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+			update: mutateResult{plugins: tasks("monitor"), injected: tasks("monitor"), warnings: []string{
+				"plugin 'monitor' conflicts with the user-defined plugin of the same name, the user-defined plugin is overwritten",
+			}},
+		},
+		{
+			name:    "conditions are matched against the submitted Terraform",
+			plugins: map[string]string{"monitor": strings.Replace(monitor, "{", `{"conditions": {"tasksConfigured": ["apply"]}, `, 1)},
+			change: func(tf *tfv1beta1.Terraform) {
+				tf.Spec.TaskOptions = append(tf.Spec.TaskOptions, tfv1beta1.TaskOption{For: tasks("apply")})
+			},
+			create: mutateResult{},
+			update: mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+		},
+		{
+			name:    "expression",
+			plugins: map[string]string{"monitor": strings.Replace(monitor, "{", `{"expression": "request.operation == \"UPDATE\"", `, 1)},
+			create:  mutateResult{},
+			update:  mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+		},
+		{
+			name:      "fragments are applied once",
+			plugins:   map[string]string{"monitor": strings.Replace(monitor, "{", `{"mergePatch": {"metadata": {"labels": {"team": "platform"}}}, `, 1)},
+			create:    mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+			update:    mutateResult{plugins: tasks("monitor"), injected: tasks("monitor")},
+			unchanged: true,
+			check: func(t *testing.T, created, updated *tfv1beta1.Terraform) {
+				if created.Labels["team"] != "platform" {
+					t.Errorf("labels = %v, want the label of the patch", created.Labels)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := tt.policy
+			if policy == "" {
+				policy = ConflictPolicyPriorityWins
+			}
+			m := testMutationHandler(t, policy, tt.plugins)
+			namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			namespace := tt.namespace.DeepCopy()
+			namespace.Name = "team-a"
+			if err := namespaces.Add(namespace); err != nil {
+				t.Fatal(err)
+			}
+			m.namespaces = corelisters.NewNamespaceLister(namespaces)
+			configMaps := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			if err := configMaps.Add(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "plugins", Namespace: "team-a"}, Data: tt.namespacePlugins}); err != nil {
+				t.Fatal(err)
+			}
+			m.namespacePlugins = corelisters.NewConfigMapLister(configMaps)
+			m.namespacePluginPolicy = DefaultNamespacePluginPolicy()
+			m.namespacePluginPolicy.AllowedRegistries = []string{"ghcr.io/team-a"}
+
+			tf := tt.tf.DeepCopy()
+			tf.Name, tf.Namespace = "stack", "team-a"
+			response, created := testMutate(t, m, admission.Create, tf)
+			checkMutateResult(t, "create", response, created, tt.create)
+			if created == nil {
+				return
+			}
+
+			updated := created.DeepCopy()
+			if tt.change != nil {
+				tt.change(updated)
+			}
+			response, updated = testMutate(t, m, admission.Update, updated)
+			checkMutateResult(t, "update", response, updated, tt.update)
+			if tt.unchanged && string(response.Patch) != "[]" {
+				t.Errorf("update patch = %s, want no changes", response.Patch)
+			}
+			if tt.check != nil && updated != nil {
+				tt.check(t, created, updated)
+			}
+		})
+	}
+}
+
+// checkMutateResult compares the response of an admission and the Terraform it returned to the result
+func checkMutateResult(t *testing.T, operation string, response *admission.AdmissionResponse, tf *tfv1beta1.Terraform, want mutateResult) {
+	t.Helper()
+	if want.denied != "" || tf == nil {
+		if tf != nil || response.Result == nil || response.Result.Message != want.denied {
+			t.Errorf("%s was allowed %v with %v, want it denied with %q", operation, response.Allowed, response.Result, want.denied)
+		}
+		return
+	}
+	plugins := map[tfv1beta1.TaskName]bool{}
+	for name := range tf.Spec.Plugins {
+		plugins[name] = true
+	}
+	injected := map[tfv1beta1.TaskName]bool{}
+	for name := range readInjectedRecord(tf).Plugins {
+		injected[name] = true
+	}
+	if got := sortedTaskNames(plugins); len(got) > 0 || len(want.plugins) > 0 {
+		if !reflect.DeepEqual(got, want.plugins) {
+			t.Errorf("%s plugins = %v, want %v", operation, got, want.plugins)
+		}
+	}
+	if got := sortedTaskNames(injected); len(got) > 0 || len(want.injected) > 0 {
+		if !reflect.DeepEqual(got, want.injected) {
+			t.Errorf("%s injected plugins = %v, want %v", operation, got, want.injected)
+		}
+	}
+	if len(response.Warnings) > 0 || len(want.warnings) > 0 {
+		if !reflect.DeepEqual(response.Warnings, want.warnings) {
+			t.Errorf("%s warnings = %q, want %q", operation, response.Warnings, want.warnings)
+		}
+	}
+}
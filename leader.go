@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leading checks if this replica manages the certs and the webhook configuration. Every replica leads
+// when leader election is disabled.
+func (m Manager) leading() bool {
+	return m.leader.Load()
+}
+
+// runLeaderElection campaigns for the lease until the manager's context is done. Only the leader
+// creates and rotates the certs and reconciles the webhook configuration. Every replica serves
+// mutations from the shared secret whether or not it leads.
+func (m Manager) runLeaderElection() {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      m.leaderElectionID,
+			Namespace: m.namespace,
+		},
+		Client: m.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: m.identity,
+		},
+	}
+
+	for m.ctx.Err() == nil {
+		leaderelection.RunOrDie(m.ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            m.leaderElectionID,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					logger.Info("Acquired lease", "lease", m.leaderElectionID, "identity", m.identity)
+					m.leader.Store(true)
+					m.wake()
+				},
+				OnStoppedLeading: func() {
+					logger.Info("Lost lease", "lease", m.leaderElectionID)
+					m.leader.Store(false)
+				},
+				OnNewLeader: func(identity string) {
+					if identity != m.identity {
+						logger.Info("New leader elected", "lease", m.leaderElectionID, "leader", identity)
+					}
+				},
+			},
+		})
+	}
+}
+
+// wake interrupts the cert management wait so a new leader reconciles right away
+func (m Manager) wake() {
+	select {
+	case m.wakeCh <- true:
+	default:
+	}
+}
+
+// wait pauses the cert management loop for d or until it is woken up or stopped
+func (m Manager) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-m.wakeCh:
+	case <-m.ctx.Done():
+	}
+}
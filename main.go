@@ -9,16 +9,27 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/galleybytes/terraform-operator-plugin-manager/internal/logging"
 	"github.com/galleybytes/terraform-operator-plugin-manager/internal/webserver"
+	"github.com/go-logr/logr"
 	"github.com/isaaguilar/selfsigned"
 	addmissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
 )
 
 var (
@@ -31,8 +42,66 @@ var (
 	mutatingWebhookConfigurationName string
 	serviceName                      string
 	secretName                       string
+	certSource                       string
+	certManagerCertificateName       string
+	certManagerIssuerName            string
+	certManagerIssuerKind            string
+	certManagerIssuerGroup           string
+	certManagerInjectCA              bool
+	certValidity                     time.Duration
+	caValidity                       time.Duration
+	certRenewBefore                  time.Duration
+	certRecheckInterval              time.Duration
+	certKeyAlgorithm                 string
+	certKeySize                      int
+	caRolloverGracePeriod            time.Duration
+	webhookFailurePolicy             string
+	webhookMatchPolicy               string
+	webhookReinvocationPolicy        string
+	webhookScope                     string
+	webhookTimeoutSeconds            int
+	webhookPort                      int
+	webhookPath                      string
+	webhookNamespaceSelector         string
+	webhookObjectSelector            string
+	webhookExcludeNamespaces         string
 	// TFO Plugin Mutations
 	pluginMutationsFilepath string
+	pluginReloadInterval    time.Duration
+	conflictPolicy          webserver.ConflictPolicy
+	// Webhook registration
+	webhookOpts webhookOptions
+	// Cert generation and renewal
+	certOpts certOptions
+	// Leader election
+	leaderElect      bool
+	leaderElectionID string
+	// Events
+	deploymentName string
+	// Mounted certs
+	mountSyncTimeout time.Duration
+	certsFromSecret  bool
+	// Namespace plugin settings
+	namespacePluginSettings bool
+	namespacePlugins        bool
+	namespacePluginPolicy   string
+	imagePolicy             string
+	protectedPaths          string
+	// Audit
+	auditSink        string
+	auditFilename    string
+	auditURL         string
+	auditHTTPTimeout time.Duration
+	auditBufferSize  int
+	// Metrics
+	metricsAddr string
+	// Logging
+	logFormat string
+	logLevel  string
+	logger    logr.Logger
+	// Shutdown
+	shutdownDelay   time.Duration
+	shutdownTimeout time.Duration
 	// API access
 	apiServiceHost string
 	apiUsername    string
@@ -50,95 +119,271 @@ func getFlags() {
 	flag.StringVar(&apiServiceHost, "api", "http://terraform-operator-api.tf-system.svc", "TFO api host - proto://host:port")
 	flag.StringVar(&serviceName, "service-name", "terraform-operator-plugin-manager", "Name of the service to back up mutating webhook configuration")
 	flag.StringVar(&pluginMutationsFilepath, "plugin-mutations", "/plugins", "Path to plugin mutations")
+	flag.DurationVar(&pluginReloadInterval, "plugin-reload-interval", 10*time.Second, "How often the plugin mutations are checked for changes, invalid changes are reported and the previous plugins are kept")
+	flag.StringVar(&certSource, "cert-source", certSourceSelfSigned, "Where certs come from - self-signed, cert-manager or mounted")
+	flag.DurationVar(&certValidity, "cert-validity", 365*24*time.Hour, "How long new TLS certs are valid for")
+	flag.DurationVar(&caValidity, "ca-validity", 25*365*24*time.Hour, "How long new self-signed CA certs are valid for")
+	flag.DurationVar(&certRenewBefore, "cert-renew-before", 30*24*time.Hour, "Renew certs when they expire within this window")
+	flag.DurationVar(&certRecheckInterval, "cert-recheck-interval", 24*time.Hour, "Longest time between cert checks, certs are also checked when they enter the renewal window")
+	flag.StringVar(&certKeyAlgorithm, "cert-key-algorithm", keyAlgorithmRSA, "Algorithm of new keys - rsa or ecdsa")
+	flag.IntVar(&certKeySize, "cert-key-size", 2048, "Size of new keys - RSA bits or the ECDSA curve (256, 384 or 521)")
+	flag.DurationVar(&caRolloverGracePeriod, "ca-rollover-grace-period", time.Hour, "How long the old and new self-signed CAs are both trusted when the CA is rolled over")
+	flag.StringVar(&certManagerCertificateName, "cert-manager-certificate-name", "terraform-operator-plugin-manager", "Name of the cert-manager Certificate that issues the certs into the secret")
+	flag.StringVar(&certManagerIssuerName, "cert-manager-issuer-name", "", "Name of the cert-manager issuer, it should populate 'ca.crt' unless the CA is injected")
+	flag.StringVar(&certManagerIssuerKind, "cert-manager-issuer-kind", "Issuer", "Kind of the cert-manager issuer - Issuer or ClusterIssuer")
+	flag.StringVar(&certManagerIssuerGroup, "cert-manager-issuer-group", "cert-manager.io", "API group of the cert-manager issuer")
+	flag.BoolVar(&certManagerInjectCA, "cert-manager-inject-ca", true, "Let the cert-manager CA injector manage the webhook's caBundle instead of the manager")
+	flag.StringVar(&webhookFailurePolicy, "webhook-failure-policy", string(addmissionregistrationv1.Fail), "Failure policy of the webhook - Fail or Ignore")
+	flag.StringVar(&webhookMatchPolicy, "webhook-match-policy", string(addmissionregistrationv1.Equivalent), "Match policy of the webhook - Exact or Equivalent")
+	flag.StringVar(&webhookReinvocationPolicy, "webhook-reinvocation-policy", string(addmissionregistrationv1.NeverReinvocationPolicy), "Reinvocation policy of the webhook - Never or IfNeeded")
+	flag.StringVar(&webhookScope, "webhook-scope", string(addmissionregistrationv1.AllScopes), "Scope of the webhook rule - *, Namespaced or Cluster")
+	flag.IntVar(&webhookTimeoutSeconds, "webhook-timeout-seconds", 30, "Seconds the API server waits on the webhook (1-30)")
+	flag.IntVar(&webhookPort, "webhook-port", 443, "Port of the service the API server calls")
+	flag.StringVar(&webhookPath, "webhook-path", "/mutate", "Path the API server calls and the webserver serves mutations on")
+	flag.StringVar(&webhookNamespaceSelector, "webhook-namespace-selector", "", "Label selector of the namespaces the webhook applies to")
+	flag.StringVar(&webhookObjectSelector, "webhook-object-selector", "", "Label selector of the terraforms the webhook applies to")
+	flag.StringVar(&webhookExcludeNamespaces, "webhook-exclude-namespaces", "", "Comma separated namespaces the webhook never applies to (default kube-system and the -namespace)")
+	flag.BoolVar(&leaderElect, "leader-elect", true, "Elect a leader to manage certs and the webhook so multiple replicas can run")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "terraform-operator-plugin-manager", "Name of the lease used for leader election")
+	flag.StringVar(&deploymentName, "deployment-name", "terraform-operator-plugin-manager", "Name of the manager's deployment that events are recorded on")
+	flag.DurationVar(&mountSyncTimeout, "mount-sync-timeout", 3*time.Minute, "Time to wait for the mounted certs to match the secret before serving the certs from the secret")
+	flag.BoolVar(&certsFromSecret, "certs-from-secret", false, "Serve the certs straight from the secret via an informer so the secret does not need to be mounted")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", 5*time.Second, "Time to keep serving after a termination signal so the endpoint is removed before the server stops")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 20*time.Second, "Time to wait for in-flight admission requests to finish when stopping")
+	flag.BoolVar(&namespacePluginSettings, "namespace-plugin-settings", true, "Let namespace labels and annotations enable or disable plugins, the namespaces are watched")
+	flag.BoolVar(&namespacePlugins, "namespace-plugins", false, "Let namespaces define their own plugins in ConfigMaps labeled "+webserver.NamespacePluginsLabel+"=true")
+	flag.StringVar(&namespacePluginPolicy, "namespace-plugin-policy", "", "JSON file with the policy for namespace plugins, the allowed fields and registries (default allows no registries, so no namespace plugins)")
+	flag.StringVar(&imagePolicy, "image-policy", "", "JSON file with the policy for plugin images, the allowed registries, digest pinning and the latest tag (default only warns on the latest tag)")
+	flag.StringVar(&protectedPaths, "protected-paths", strings.Join(webserver.DefaultProtectedPaths, ","), "Comma separated JSON pointers of the Terraform fields plugin patches must not change, segments may be patterns")
+	flag.StringVar(&auditSink, "audit-sink", "none", "Where a record of every admission response is written - none, stdout, file or http")
+	flag.StringVar(&auditFilename, "audit-file", "/var/log/plugin-manager/audit.jsonl", "File audit records are appended to as JSON lines when the audit sink is file")
+	flag.StringVar(&auditURL, "audit-url", "", "URL audit records are posted to when the audit sink is http")
+	flag.DurationVar(&auditHTTPTimeout, "audit-http-timeout", 5*time.Second, "Timeout of posting an audit record when the audit sink is http")
+	flag.IntVar(&auditBufferSize, "audit-buffer-size", 1000, "Number of audit records that can wait to be written, later records are dropped until the sink catches up")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address metrics are served on over plain HTTP at /debug/vars, eg :8080 (default not served)")
+	flag.StringVar(&logFormat, "log-format", logging.FormatText, "Format of the logs - text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "Level of the logs - info or debug")
+	conflictPolicyFlag := flag.String("conflict-policy", string(webserver.ConflictPolicyPriorityWins), "How plugins that run at the same task and when, or share a name with a user-defined plugin, are resolved - error, first-wins or priority-wins")
 	flag.Parse()
 
+	var err error
+	logger, err = logging.New(logFormat, logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webserver.SetLogger(logger.WithName("webserver"))
+	klog.SetLogger(logger.WithName("client-go"))
+
+	conflictPolicy, err = webserver.ParseConflictPolicy(*conflictPolicyFlag)
+	if err != nil {
+		fatal(err, "Invalid flag", "flag", "conflict-policy")
+	}
+
+	switch certSource {
+	case certSourceSelfSigned, certSourceMounted:
+	case certSourceCertManager:
+		if certManagerIssuerName == "" {
+			fatal(fmt.Errorf("-cert-manager-issuer-name is required when the cert source is cert-manager"), "Invalid flag", "flag", "cert-manager-issuer-name")
+		}
+	default:
+		fatal(fmt.Errorf("unknown cert source '%s'", certSource), "Invalid flag", "flag", "cert-source")
+	}
+	switch auditSink {
+	case "none", "stdout", "file":
+	case "http":
+		if auditURL == "" {
+			fatal(fmt.Errorf("-audit-url is required when the audit sink is http"), "Invalid flag", "flag", "audit-url")
+		}
+	default:
+		fatal(fmt.Errorf("unknown audit sink '%s'", auditSink), "Invalid flag", "flag", "audit-sink")
+	}
+	if auditBufferSize < 0 {
+		fatal(fmt.Errorf("-audit-buffer-size can not be negative"), "Invalid flag", "flag", "audit-buffer-size")
+	}
+
+	if certsFromSecret && certSource == certSourceMounted {
+		fatal(fmt.Errorf("-certs-from-secret can not be used when the cert source is mounted"), "Invalid flag", "flag", "certs-from-secret")
+	}
+
+	certOpts = certOptions{
+		validity:              certValidity,
+		caValidity:            caValidity,
+		renewBefore:           certRenewBefore,
+		recheckInterval:       certRecheckInterval,
+		caRolloverGracePeriod: caRolloverGracePeriod,
+		keyAlgorithm:          certKeyAlgorithm,
+		keySize:               certKeySize,
+	}
+	if err := certOpts.validate(); err != nil {
+		fatal(err, "Invalid cert flags")
+	}
+
+	// Excluding the system namespaces is the default unless the flag is explicitly set, even to nothing
+	excludeNamespacesSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "webhook-exclude-namespaces" {
+			excludeNamespacesSet = true
+		}
+	})
+	if !excludeNamespacesSet {
+		webhookExcludeNamespaces = "kube-system," + namespace
+	}
+	webhookOpts, err = newWebhookOptions()
+	if err != nil {
+		fatal(err, "Invalid webhook flags")
+	}
+
 	apiUsername = os.Getenv("API_USERNAME")
 	apiPassword = os.Getenv("API_PASSWORD")
 }
 
-// getClientOrDie returns the core k8s client.
-func getClientOrDie(kubeconfigPath string) kubernetes.Interface {
+// newAuditSink returns the sink selected by the flags, nil when admission responses are not audited
+func newAuditSink() (webserver.AuditSink, error) {
+	switch auditSink {
+	case "stdout":
+		return webserver.NewStdoutAuditSink(), nil
+	case "file":
+		return webserver.NewFileAuditSink(auditFilename)
+	case "http":
+		return webserver.NewHTTPAuditSink(auditURL, auditHTTPTimeout), nil
+	}
+	return nil, nil
+}
+
+// fatal logs the error and exits
+func fatal(err error, msg string, keysAndValues ...interface{}) {
+	logger.Error(err, msg, keysAndValues...)
+	os.Exit(1)
+}
+
+// getClientOrDie returns the core k8s client and a dynamic client for resources without a typed client.
+func getClientOrDie(kubeconfigPath string) (kubernetes.Interface, dynamic.Interface) {
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
 	if err != nil {
-		log.Fatal("Failed to get config for clientset")
+		fatal(err, "Failed to get config for clientset")
 	}
-	return kubernetes.NewForConfigOrDie(config)
+	return kubernetes.NewForConfigOrDie(config), dynamic.NewForConfigOrDie(config)
 }
 
 type Manager struct {
 	ctx                              context.Context
 	clientset                        kubernetes.Interface
+	dynamicClient                    dynamic.Interface
 	caKeyFilename                    string
 	caCertFilename                   string
 	tlsKeyFilename                   string
 	tlsCertFilename                  string
+	mountSyncTimeout                 time.Duration
+	certsFromSecret                  bool
+	secretLister                     corelisters.SecretLister
+	servingCert                      *webserver.ServingCert
 	namespace                        string
 	secretName                       string
+	certSource                       string
+	certManager                      certManagerOptions
+	certs                            certOptions
 	serviceName                      string
 	dnsNames                         []string
 	mutatingWebhookConfigurationName string
+	webhook                          webhookOptions
+	leaderElectionID                 string
+	identity                         string
+	leader                           *atomic.Bool
+	deploymentName                   string
+	recorder                         record.EventRecorder
+	readiness                        *readiness
+	wakeCh                           chan (bool)
 	isReadyCh                        chan (bool)
 	started                          bool
 }
 
-func (m Manager) GetOrCreateSecret() *corev1.Secret {
+// getSecret returns the secret without creating it. Replicas that do not lead wait for the leader to
+// create it.
+func (m Manager) getSecret() (*corev1.Secret, error) {
+	if m.secretLister != nil {
+		return m.cachedSecret()
+	}
+	var secret *corev1.Secret
+	err := retry.OnError(retryBackoff, retriable, func() error {
+		var err error
+		secret, err = m.clientset.CoreV1().Secrets(m.namespace).Get(m.ctx, m.secretName, metav1.GetOptions{})
+		return err
+	})
+	return secret, err
+}
+
+func (m Manager) GetOrCreateSecret() (*corev1.Secret, error) {
 	secretClient := m.clientset.CoreV1().Secrets(m.namespace)
 
-	secret, err := secretClient.Get(m.ctx, m.secretName, metav1.GetOptions{})
-	if err != nil {
-		if errors.IsNotFound(err) {
-			selfSignedCert := selfsigned.NewSelfSignedCertOrDie(m.dnsNames)
-			secret, err = secretClient.Create(
-				m.ctx,
-				&corev1.Secret{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      m.secretName,
-						Namespace: m.namespace,
-					},
-					Type: corev1.SecretTypeTLS,
-					Data: map[string][]byte{
-						"ca.key":  selfSignedCert.CAKey,
-						"ca.crt":  selfSignedCert.CACert,
-						"tls.crt": selfSignedCert.TLSCert,
-						"tls.key": selfSignedCert.TLSKey,
-					},
+	var secret *corev1.Secret
+	err := retry.OnError(retryBackoff, retriable, func() error {
+		var err error
+		secret, err = secretClient.Get(m.ctx, m.secretName, metav1.GetOptions{})
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		selfSignedCert, err := m.certs.newSelfSignedCert(m.dnsNames)
+		if err != nil {
+			return err
+		}
+		// An AlreadyExists error is retried which gets the secret another replica created
+		secret, err = secretClient.Create(
+			m.ctx,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      m.secretName,
+					Namespace: m.namespace,
 				},
-				metav1.CreateOptions{},
-			)
-			if err != nil {
-				log.Panic(err)
-			}
-			log.Printf("Created TLS certs in secret/%s\n", secret.Name)
-		} else {
-			log.Panic(err)
+				Type: corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					"ca.key":  selfSignedCert.CAKey,
+					"ca.crt":  selfSignedCert.CACert,
+					"tls.crt": selfSignedCert.TLSCert,
+					"tls.key": selfSignedCert.TLSKey,
+				},
+			},
+			metav1.CreateOptions{},
+		)
+		if err != nil {
+			return err
 		}
-	}
-	return secret
+		logger.Info("Created TLS certs", "secret", secret.Name)
+		m.recorder.Eventf(m.deploymentRef(), corev1.EventTypeNormal, "CertsCreated", "Created the certs in 'secret/%s'", secret.Name)
+		return nil
+	})
+	return secret, err
 }
 
-func (m Manager) UpdateSecret(selfSignedCert *selfsigned.SelfSignedCert) *corev1.Secret {
-	err := selfSignedCert.UpdateTLS()
+func (m Manager) UpdateSecret(selfSignedCert *selfsigned.SelfSignedCert) (*corev1.Secret, error) {
+	err := m.certs.renew(selfSignedCert, m.dnsNames)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	secretClient := m.clientset.CoreV1().Secrets(m.namespace)
-	secret, err := secretClient.Get(m.ctx, m.secretName, metav1.GetOptions{})
-	if err != nil && errors.IsNotFound(err) {
-		log.Panicf("Expected secret '%s' to exist but was not found", m.secretName)
-	}
-	secret.Data = map[string][]byte{
-		"ca.key":  selfSignedCert.CAKey,
-		"ca.crt":  selfSignedCert.CACert,
-		"tls.crt": selfSignedCert.TLSCert,
-		"tls.key": selfSignedCert.TLSKey,
-	}
-
-	secret, err = secretClient.Update(m.ctx, secret, metav1.UpdateOptions{})
-	if err != nil {
-		log.Panic(err)
-	}
 
-	return secret
+	var secret *corev1.Secret
+	// Conflicts are retried with the latest version of the secret
+	err = retry.OnError(retryBackoff, retriable, func() error {
+		var err error
+		secret, err = secretClient.Get(m.ctx, m.secretName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		// A replaced ca ends any ca rollover in progress
+		if string(secret.Data["ca.crt"]) != string(selfSignedCert.CACert) {
+			clearCARollover(secret)
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data["ca.key"] = selfSignedCert.CAKey
+		secret.Data["ca.crt"] = selfSignedCert.CACert
+		secret.Data["tls.crt"] = selfSignedCert.TLSCert
+		secret.Data["tls.key"] = selfSignedCert.TLSKey
+		secret, err = secretClient.Update(m.ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	return secret, err
 }
 
 func x509Cert(certData []byte) (*x509.Certificate, error) {
@@ -153,36 +398,6 @@ func x509Cert(certData []byte) (*x509.Certificate, error) {
 	return cert, nil
 }
 
-// isCertValid checks cert expiration and cert dns names
-func isCertValid(caCertData, tlsCertData []byte, dnsNames []string) bool {
-	roots := x509.NewCertPool()
-	ok := roots.AppendCertsFromPEM(caCertData)
-	if !ok {
-		log.Println("failed to parse root certificate")
-		return false
-	}
-
-	cert, err := x509Cert(tlsCertData)
-	if err != nil {
-		log.Println(err.Error())
-		return false
-	}
-
-	t := time.Now()
-	opts := x509.VerifyOptions{
-		CurrentTime: t.Add(24 * 30 * time.Hour), // 30 days
-		DNSName:     dnsNames[0],
-		Roots:       roots,
-	}
-
-	if _, err := cert.Verify(opts); err != nil {
-		log.Println("failed to verify certificate: " + err.Error())
-		return false
-	}
-
-	return true
-}
-
 func fileExistAndIsNotEmpty(filename string) bool {
 	file, err := os.Stat(filename)
 	if err != nil {
@@ -197,162 +412,146 @@ func fileExistAndIsNotEmpty(filename string) bool {
 	return true
 }
 
-func isX509Format(b []byte) bool {
-	block, _ := pem.Decode(b)
-	if block == nil {
-		return false
-	}
-	isKey := false
-	isCert := false
+// managesCAKey checks if the manager signs the certs itself and so has the CA key in the secret
+func (m Manager) managesCAKey() bool {
+	return m.certSource == certSourceSelfSigned
+}
 
-	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
-		isKey = true
+// ensureSecret returns the secret with the certs. A nil secret means cert-manager has not issued the
+// certs yet.
+func (m Manager) ensureSecret() (*corev1.Secret, error) {
+	if m.certSource != certSourceCertManager {
+		return m.GetOrCreateSecret()
 	}
-	if _, err := x509.ParseCertificate(block.Bytes); err == nil {
-		isCert = true
+	if err := m.createOrUpdateCertificate(); err != nil {
+		return nil, err
 	}
-	if !isKey && !isCert {
-		return false
+	secret, err := m.getSecret()
+	if errors.IsNotFound(err) {
+		return nil, nil
 	}
-	return true
-}
-
-// int32p returns an int32 pointer to the int32 value passed in
-func int32p(x int32) *int32 {
-	return &x
-}
-
-// stringp returns an string pointer to the string value passed in
-func stringp(s string) *string {
-	return &s
+	return secret, err
 }
 
-func (m Manager) createOrUpdateMutatingWebhookConfiguration() {
-
-	mutatingWebhookConfigurationClient := m.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
-	_, err := mutatingWebhookConfigurationClient.Get(m.ctx, m.mutatingWebhookConfigurationName, metav1.GetOptions{})
-	if err != nil {
-		if !errors.IsNotFound(err) {
-			log.Panic(err)
-		}
-
-		// Create it
-		caBundle, err := m.caBundle()
-		if err != nil {
-			log.Panic(err)
-		}
-		fail := addmissionregistrationv1.Fail
-		none := addmissionregistrationv1.SideEffectClassNone
-		mutatingWebhook := addmissionregistrationv1.MutatingWebhook{
-			Name: fmt.Sprintf("%s.galleybytes.com", m.mutatingWebhookConfigurationName),
-			ClientConfig: addmissionregistrationv1.WebhookClientConfig{
-				CABundle: caBundle,
-				Service: &addmissionregistrationv1.ServiceReference{
-					Namespace: m.namespace,
-					Name:      m.serviceName,
-					Port:      int32p(443),
-					Path:      stringp("/mutate"),
-				},
-			},
-			AdmissionReviewVersions: []string{"v1"},
-			TimeoutSeconds:          int32p(30),
-			Rules: []addmissionregistrationv1.RuleWithOperations{
-				{
-					Operations: []addmissionregistrationv1.OperationType{addmissionregistrationv1.Create, addmissionregistrationv1.Update},
-					Rule: addmissionregistrationv1.Rule{
-						APIGroups:   []string{"tf.galleybytes.com"},
-						APIVersions: []string{"v1beta1"},
-						Resources:   []string{"terraforms"},
-					},
-				},
-			},
-			FailurePolicy: &fail,
-			SideEffects:   &none,
-		}
-		mutatingWebhookConfiguration := addmissionregistrationv1.MutatingWebhookConfiguration{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: m.mutatingWebhookConfigurationName,
-			},
-			Webhooks: []addmissionregistrationv1.MutatingWebhook{
-				mutatingWebhook,
-			},
+// readMountedCerts reads the ca key, ca cert, tls key and tls cert files. The ca key is only read when
+// the manager signs the certs and the ca cert only when the CA injector does not set the caBundle.
+func (m Manager) readMountedCerts() (caKey, caCert, tlsKey, tlsCert []byte, err error) {
+	if m.managesCAKey() {
+		if caKey, err = ioutil.ReadFile(m.caKeyFilename); err != nil {
+			return
 		}
-		_, err = mutatingWebhookConfigurationClient.Create(m.ctx, &mutatingWebhookConfiguration, metav1.CreateOptions{})
-		if err != nil {
-			log.Panic(err)
+	}
+	if !m.injectsCA() {
+		if caCert, err = ioutil.ReadFile(m.caCertFilename); err != nil {
+			return
 		}
-		log.Println("Created new mutating webhook configuration")
-
 	}
+	if tlsKey, err = ioutil.ReadFile(m.tlsKeyFilename); err != nil {
+		return
+	}
+	tlsCert, err = ioutil.ReadFile(m.tlsCertFilename)
+	return
 }
 
-func (m Manager) caBundle() ([]byte, error) {
-	foundCACert := fileExistAndIsNotEmpty(m.caCertFilename)
-	if !foundCACert {
-		return []byte{}, fmt.Errorf("could not find '%s'", m.caCertFilename)
+// mountedCertsMatching reads the mounted certs and checks they match the certs in the secret
+func (m Manager) mountedCertsMatching(secret *corev1.Secret) (caKey, caCert, tlsKey, tlsCert []byte, err error) {
+	// The CA key is only available when the manager signs the certs
+	foundCAKey := !m.managesCAKey() || fileExistAndIsNotEmpty(m.caKeyFilename)
+	// Issuers like ACME leave the CA cert empty, it is not needed when the CA injector sets the caBundle
+	foundCACert := m.injectsCA() || fileExistAndIsNotEmpty(m.caCertFilename)
+	foundTLSKey := fileExistAndIsNotEmpty(m.tlsKeyFilename)
+	foundTLSCert := fileExistAndIsNotEmpty(m.tlsCertFilename)
+	if !foundCAKey || !foundCACert || !foundTLSKey || !foundTLSCert {
+		err = fmt.Errorf("certs are not mounted")
+		return
 	}
-	caCert, err := ioutil.ReadFile(m.caCertFilename)
+
+	caKey, caCert, tlsKey, tlsCert, err = m.readMountedCerts()
 	if err != nil {
-		return []byte{}, err
+		err = fmt.Errorf("failed to read mounted certs: %s", err)
+		return
+	}
+	if (m.managesCAKey() && string(secret.Data["ca.key"]) != string(caKey)) ||
+		(!m.injectsCA() && string(secret.Data["ca.crt"]) != string(caCert)) ||
+		string(secret.Data["tls.key"]) != string(tlsKey) ||
+		string(secret.Data["tls.crt"]) != string(tlsCert) {
+		err = fmt.Errorf("mounted certs do not match certs in 'secret/%s'", m.secretName)
 	}
-	return caCert, nil
+	return
+}
+
+// secretCerts returns the certs in the secret
+func (m Manager) secretCerts(secret *corev1.Secret) (caKey, caCert, tlsKey, tlsCert []byte) {
+	if m.managesCAKey() {
+		caKey = secret.Data["ca.key"]
+	}
+	return caKey, secret.Data["ca.crt"], secret.Data["tls.key"], secret.Data["tls.crt"]
 }
 
 func (m Manager) certMgmt() {
 	recheckAfter := time.Duration(10 * time.Second)
-	for {
-		secret := m.GetOrCreateSecret()
-		foundCAKey := fileExistAndIsNotEmpty(m.caKeyFilename)
-		foundCACert := fileExistAndIsNotEmpty(m.caCertFilename)
-		foundTLSKey := fileExistAndIsNotEmpty(m.tlsKeyFilename)
-		foundTLSCert := fileExistAndIsNotEmpty(m.tlsCertFilename)
-		if !foundCAKey || !foundCACert || !foundTLSKey || !foundTLSCert {
-			log.Println("Waiting for certs to be mounted")
-			recheckAfter = time.Duration(10 * time.Second)
-			time.Sleep(recheckAfter)
-			continue
-		}
-
-		caKey, err := ioutil.ReadFile(m.caKeyFilename)
-		if err != nil {
-			log.Panic(err)
-		}
-		caCert, err := ioutil.ReadFile(m.caCertFilename)
-		if err != nil {
-			log.Panic(err)
-		}
-		tlsCert, err := ioutil.ReadFile(m.tlsCertFilename)
-		if err != nil {
-			log.Panic(err)
+	// Mounted secrets are synced by kubelet some time after the secret changes
+	var secretResourceVersion, reportedResourceVersion string
+	secretChangedAt := time.Now()
+	for m.ctx.Err() == nil {
+		var secret *corev1.Secret
+		if m.leading() {
+			var err error
+			secret, err = m.ensureSecret()
+			if err != nil {
+				m.fail("GetOrCreateSecretFailed", fmt.Errorf("failed to get or create 'secret/%s': %s", m.secretName, err))
+				recheckAfter = time.Duration(10 * time.Second)
+				m.wait(recheckAfter)
+				continue
+			}
+			if secret == nil {
+				logger.Info("Waiting for cert-manager to issue the certs", "secret", m.secretName)
+				recheckAfter = time.Duration(10 * time.Second)
+				m.wait(recheckAfter)
+				continue
+			}
+		} else {
+			var err error
+			secret, err = m.getSecret()
+			if err != nil {
+				logger.Info("Waiting for the leader to create the certs", "secret", m.secretName, "reason", err.Error())
+				recheckAfter = time.Duration(10 * time.Second)
+				m.wait(recheckAfter)
+				continue
+			}
 		}
-		tlsKey, err := ioutil.ReadFile(m.tlsKeyFilename)
-		if err != nil {
-			log.Panic(err)
+		// The secret's resourceVersion tells kubelet sync lag, which follows a change to the secret, from
+		// a pod that never gets the secret mounted
+		if secret.ResourceVersion != secretResourceVersion {
+			secretResourceVersion = secret.ResourceVersion
+			secretChangedAt = time.Now()
 		}
 
-		if !isX509Format(caKey) {
-			log.Printf("Failed to parse '%s'", m.caKeyFilename)
-			recheckAfter = time.Duration(10 * time.Second)
-			time.Sleep(recheckAfter)
-			continue
-		}
-		if !isX509Format(caCert) {
-			log.Printf("Failed to parse '%s'", m.caCertFilename)
-			recheckAfter = time.Duration(10 * time.Second)
-			time.Sleep(recheckAfter)
-			continue
-		}
-		if !isX509Format(tlsKey) {
-			log.Printf("Failed to parse '%s'", m.tlsKeyFilename)
-			recheckAfter = time.Duration(10 * time.Second)
-			time.Sleep(recheckAfter)
-			continue
+		// The certs are read from the secret when it is not mounted or the mount never catches up
+		fromSecret := m.certsFromSecret
+		var caKey, caCert, tlsKey, tlsCert []byte
+		if !fromSecret {
+			var mountErr error
+			caKey, caCert, tlsKey, tlsCert, mountErr = m.mountedCertsMatching(secret)
+			if mountErr != nil {
+				if time.Since(secretChangedAt) < m.mountSyncTimeout {
+					logger.Info("Waiting for kubelet to sync the mounted certs", "secret", m.secretName, "reason", mountErr.Error())
+					recheckAfter = time.Duration(10 * time.Second)
+					m.wait(recheckAfter)
+					continue
+				}
+				// The pod is most likely misconfigured, serve the certs straight from the secret instead
+				if reportedResourceVersion != secret.ResourceVersion {
+					msg := fmt.Sprintf("%s after %s. The pod may be misconfigured, serving certs from 'secret/%s' instead", mountErr, m.mountSyncTimeout, m.secretName)
+					logger.Info("Mounted certs are out of sync, serving certs from the secret", "secret", m.secretName, "reason", mountErr.Error(), "timeout", m.mountSyncTimeout.String())
+					m.recorder.Event(m.deploymentRef(), corev1.EventTypeWarning, "MountedCertsOutOfSync", msg)
+					reportedResourceVersion = secret.ResourceVersion
+				}
+				fromSecret = true
+			}
 		}
-		if !isX509Format(tlsCert) {
-			log.Printf("Failed to parse '%s'", m.tlsCertFilename)
-			recheckAfter = time.Duration(10 * time.Second)
-			time.Sleep(recheckAfter)
-			continue
+		if fromSecret {
+			caKey, caCert, tlsKey, tlsCert = m.secretCerts(secret)
 		}
 
 		selfSignedCert := &selfsigned.SelfSignedCert{
@@ -364,34 +563,95 @@ func (m Manager) certMgmt() {
 			TLSKey:  tlsKey,
 		}
 
-		if string(secret.Data["ca.key"]) == string(caKey) &&
-			string(secret.Data["ca.crt"]) == string(caCert) &&
-			string(secret.Data["tls.key"]) == string(tlsKey) &&
-			string(secret.Data["tls.crt"]) == string(tlsCert) {
-			if isCertValid(caCert, tlsCert, m.dnsNames) {
-				recheckAfter = time.Duration(24 * time.Hour)
-				// recheckAfter = time.Duration(3 * time.Second)
-				log.Printf("Cert validation passed. Will re-check in %s", recheckAfter.String())
-
-				// Create or update the mutating webhook before starting the service
-				m.createOrUpdateMutatingWebhookConfiguration()
-				if !m.started {
-					m.isReadyCh <- true
-					m.started = true
+		// The CA injector puts the issuer's CA in the caBundle, which need not be in the secret
+		validationCACert := caCert
+		if m.injectsCA() {
+			validationCACert = nil
+		}
+		problem := validateCerts(caKey, validationCACert, tlsKey, tlsCert, m.dnsNames, time.Now().Add(m.certs.renewBefore))
+		if problem == nil {
+			recheckAfter = m.certs.nextCheck(tlsCert)
+			logger.V(1).Info("Cert validation passed", "recheckAfter", recheckAfter.String())
+
+			if fromSecret {
+				if err := m.servingCert.Set(tlsCert, tlsKey); err != nil {
+					m.fail("ServingCertFailed", fmt.Errorf("failed to serve certs from 'secret/%s': %s", m.secretName, err))
+					recheckAfter = time.Duration(10 * time.Second)
+					m.wait(recheckAfter)
+					continue
+				}
+				// Keep checking if the mount catches up so the files are served again
+				if !m.certsFromSecret && recheckAfter > m.mountSyncTimeout {
+					recheckAfter = m.mountSyncTimeout
 				}
 			} else {
-				log.Printf("Certs are no longer valid. Updating secret '%s' with new certs\n", m.secretName)
-				m.UpdateSecret(selfSignedCert)
-				recheckAfter = time.Duration(10 * time.Second)
+				m.servingCert.UseFiles()
 			}
+
+			// Create or update the mutating webhook before starting the service
+			if m.leading() {
+				if err := m.createOrUpdateMutatingWebhookConfiguration(caCert); err != nil {
+					m.fail("WebhookReconcileFailed", fmt.Errorf("failed to reconcile mutatingwebhookconfiguration/%s: %s", m.mutatingWebhookConfigurationName, err))
+					recheckAfter = time.Duration(10 * time.Second)
+					m.wait(recheckAfter)
+					continue
+				}
+			}
+			m.readiness.set(nil)
+			if !m.started {
+				select {
+				case m.isReadyCh <- true:
+				case <-m.ctx.Done():
+					return
+				}
+				m.started = true
+			}
+
+			// Each phase of a ca rollover starts once the previous one is mounted and in the caBundle
+			if m.leading() && m.managesCAKey() {
+				rolloverRecheck, err := m.advanceCARollover(secret)
+				if err != nil {
+					m.fail("CARolloverFailed", fmt.Errorf("failed to roll over the ca in 'secret/%s': %s", m.secretName, err))
+					rolloverRecheck = time.Duration(10 * time.Second)
+				}
+				if rolloverRecheck > 0 && rolloverRecheck < recheckAfter {
+					recheckAfter = rolloverRecheck
+				}
+			}
+		} else if problem.wait {
+			logger.Info("Certs are not valid yet, waiting", "reason", problem.reason, "detail", problem.err)
+			recheckAfter = time.Duration(10 * time.Second)
+		} else if m.certSource == certSourceCertManager {
+			logger.Info("Certs are no longer valid, waiting for cert-manager to renew them", "secret", m.secretName, "reason", problem.reason, "detail", problem.err)
+			recheckAfter = time.Duration(10 * time.Second)
+		} else if m.leading() {
+			logger.Info("Certs are no longer valid, updating the secret with new certs", "secret", m.secretName, "reason", problem.reason, "detail", problem.err)
+			if _, err := m.UpdateSecret(selfSignedCert); err != nil {
+				m.fail("UpdateSecretFailed", fmt.Errorf("failed to update 'secret/%s': %s", m.secretName, err))
+			} else {
+				m.recorder.Eventf(m.deploymentRef(), corev1.EventTypeNormal, "CertsRenewed", "Renewed the certs in 'secret/%s' (%s)", m.secretName, problem.reason)
+			}
+			recheckAfter = time.Duration(10 * time.Second)
 		} else {
-			log.Printf("Mounted certs do not match certs in 'secret/%s'. If this error continues, the pod may be misconfigured.\n", m.secretName)
+			logger.Info("Certs are no longer valid, waiting for the leader to update the secret", "secret", m.secretName, "reason", problem.reason, "detail", problem.err)
 			recheckAfter = time.Duration(10 * time.Second)
 		}
-		time.Sleep(recheckAfter)
+		m.wait(recheckAfter)
 	}
 }
 
+// identity returns the name this replica holds the lease under
+func identity() string {
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		fatal(err, "Failed to get the hostname")
+	}
+	return hostname
+}
+
 func genDNSNames(svc, ns string) []string {
 	return []string{
 		svc,
@@ -403,23 +663,136 @@ func genDNSNames(svc, ns string) []string {
 
 func main() {
 	getFlags()
-	clientset := getClientOrDie(os.Getenv("KUBECONFIG"))
+
+	// The root context is cancelled on termination which stops every part of the manager
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	clientset, dynamicClient := getClientOrDie(os.Getenv("KUBECONFIG"))
 	mgr := Manager{
-		ctx:                              context.TODO(),
-		clientset:                        clientset,
-		caKeyFilename:                    caKeyFilename,
-		caCertFilename:                   caCertFilename,
-		tlsKeyFilename:                   tlsKeyFilename,
-		tlsCertFilename:                  tlsCertFilename,
-		namespace:                        namespace,
-		serviceName:                      serviceName,
-		secretName:                       secretName,
+		ctx:              ctx,
+		clientset:        clientset,
+		dynamicClient:    dynamicClient,
+		caKeyFilename:    caKeyFilename,
+		caCertFilename:   caCertFilename,
+		tlsKeyFilename:   tlsKeyFilename,
+		tlsCertFilename:  tlsCertFilename,
+		mountSyncTimeout: mountSyncTimeout,
+		certsFromSecret:  certsFromSecret,
+		servingCert:      webserver.NewServingCert(tlsCertFilename, tlsKeyFilename),
+		namespace:        namespace,
+		serviceName:      serviceName,
+		secretName:       secretName,
+		certSource:       certSource,
+		certManager: certManagerOptions{
+			certificateName: certManagerCertificateName,
+			issuerName:      certManagerIssuerName,
+			issuerKind:      certManagerIssuerKind,
+			issuerGroup:     certManagerIssuerGroup,
+			injectCA:        certManagerInjectCA,
+		},
+		certs:                            certOpts,
 		mutatingWebhookConfigurationName: mutatingWebhookConfigurationName,
+		webhook:                          webhookOpts,
 		dnsNames:                         genDNSNames(serviceName, namespace),
+		leaderElectionID:                 leaderElectionID,
+		identity:                         identity(),
+		leader:                           &atomic.Bool{},
+		deploymentName:                   deploymentName,
+		recorder:                         newEventRecorder(clientset),
+		readiness:                        &readiness{},
+		wakeCh:                           make(chan bool, 1),
 		isReadyCh:                        make(chan bool),
 	}
-	go mgr.certMgmt()
+	// The lease is released when the context is cancelled and main waits for it before exiting
+	leaderElectionDone := make(chan bool)
+	if leaderElect {
+		go func() {
+			mgr.runLeaderElection()
+			close(leaderElectionDone)
+		}()
+	} else {
+		mgr.leader.Store(true)
+		close(leaderElectionDone)
+	}
+	if certsFromSecret {
+		if err := mgr.watchSecret(); err != nil {
+			fatal(err, "Failed to watch the secret", "secret", secretName)
+		}
+	}
+	if certSource == certSourceMounted {
+		go mgr.mountedCertMgmt()
+	} else {
+		go mgr.certMgmt()
+	}
 
-	<-mgr.isReadyCh
-	webserver.Run(tlsCertFilename, tlsKeyFilename, pluginMutationsFilepath)
+	select {
+	case <-mgr.isReadyCh:
+	case <-ctx.Done():
+		logger.Info("Stopped before certs were ready")
+		<-leaderElectionDone
+		return
+	}
+	audit, err := newAuditSink()
+	if err != nil {
+		fatal(err, "Failed to create the audit sink", "sink", auditSink)
+	}
+	var namespaces corelisters.NamespaceLister
+	if namespacePluginSettings {
+		namespaces, err = mgr.watchNamespaces()
+		if err != nil {
+			fatal(err, "Failed to watch namespaces")
+		}
+	}
+	var namespacePluginLister corelisters.ConfigMapLister
+	policy := webserver.DefaultNamespacePluginPolicy()
+	if namespacePlugins {
+		if namespacePluginPolicy != "" {
+			policy, err = webserver.LoadNamespacePluginPolicy(namespacePluginPolicy)
+			if err != nil {
+				fatal(err, "Invalid namespace plugin policy")
+			}
+		}
+		namespacePluginLister, err = mgr.watchNamespacePlugins()
+		if err != nil {
+			fatal(err, "Failed to watch namespace plugins")
+		}
+	}
+	images := webserver.DefaultImagePolicy()
+	if imagePolicy != "" {
+		images, err = webserver.LoadImagePolicy(imagePolicy)
+		if err != nil {
+			fatal(err, "Invalid image policy")
+		}
+	}
+	// Plugin definitions that are changed into invalid ones are reported on the deployment
+	pluginsInvalid := func(err error) {
+		mgr.recorder.Event(mgr.deploymentRef(), corev1.EventTypeWarning, "PluginsInvalid", err.Error())
+	}
+	err = webserver.Run(ctx, webserver.Config{
+		ServingCert:             mgr.servingCert,
+		PluginMutationsFilepath: pluginMutationsFilepath,
+		PluginReloadInterval:    pluginReloadInterval,
+		PluginLoadFailed:        pluginsInvalid,
+		MutatePath:              webhookOpts.path,
+		ConflictPolicy:          conflictPolicy,
+		Ready:                   mgr.readiness.get,
+		ShutdownDelay:           shutdownDelay,
+		ShutdownTimeout:         shutdownTimeout,
+		Recorder:                mgr.recorder,
+		DynamicClient:           dynamicClient,
+		AuditSink:               audit,
+		AuditBufferSize:         auditBufferSize,
+		Namespaces:              namespaces,
+		NamespacePlugins:        namespacePluginLister,
+		NamespacePluginPolicy:   policy,
+		ImagePolicy:             images,
+		ProtectedPaths:          splitList(protectedPaths),
+		MetricsAddr:             metricsAddr,
+	})
+	if err != nil {
+		fatal(err, "Webserver failed")
+	}
+	<-leaderElectionDone
+	logger.Info("Stopped")
 }
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+func TestMain(m *testing.M) {
+	logger = logr.Discard()
+	os.Exit(m.Run())
+}
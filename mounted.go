@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// certSourceMounted uses certs that are mounted into the pod by other means. The manager never
+// creates or updates a secret and only warns when the certs are about to expire.
+const certSourceMounted = "mounted"
+
+// mountedCertMgmt validates the mounted certs and keeps the webhook's caBundle in sync with the
+// mounted ca cert. Expiring certs are reported as warning events since they are not rotated.
+func (m Manager) mountedCertMgmt() {
+	recheckAfter := time.Duration(10 * time.Second)
+	for m.ctx.Err() == nil {
+		foundCACert := fileExistAndIsNotEmpty(m.caCertFilename)
+		foundTLSKey := fileExistAndIsNotEmpty(m.tlsKeyFilename)
+		foundTLSCert := fileExistAndIsNotEmpty(m.tlsCertFilename)
+		if !foundCACert || !foundTLSKey || !foundTLSCert {
+			logger.Info("Waiting for certs to be mounted")
+			recheckAfter = time.Duration(10 * time.Second)
+			m.wait(recheckAfter)
+			continue
+		}
+
+		_, caCert, tlsKey, tlsCert, err := m.readMountedCerts()
+		if err != nil {
+			m.fail("ReadCertsFailed", err)
+			recheckAfter = time.Duration(10 * time.Second)
+			m.wait(recheckAfter)
+			continue
+		}
+		if problem := validateCerts(nil, caCert, tlsKey, tlsCert, m.dnsNames, time.Now()); problem != nil {
+			m.fail("CertsInvalid", fmt.Errorf("mounted certs are not valid: %s", problem))
+			recheckAfter = time.Duration(10 * time.Second)
+			m.wait(recheckAfter)
+			continue
+		}
+
+		// Certs within renewBefore of expiring are checked every 10s, so the replaced certs are picked up
+		// soon after they are mounted
+		recheckAfter = m.certs.nextCheck(tlsCert)
+		if problem := validateCerts(nil, caCert, tlsKey, tlsCert, m.dnsNames, time.Now().Add(m.certs.renewBefore)); problem != nil {
+			msg := fmt.Sprintf("Mounted certs will not be valid within %s and must be replaced (%s)", m.certs.renewBefore, problem)
+			logger.Info("Mounted certs must be replaced", "reason", problem.reason, "detail", problem.err, "renewBefore", m.certs.renewBefore.String())
+			m.recorder.Event(m.deploymentRef(), corev1.EventTypeWarning, "CertExpiringSoon", msg)
+		} else {
+			logger.V(1).Info("Cert validation passed", "recheckAfter", recheckAfter.String())
+		}
+
+		if m.leading() {
+			if err := m.createOrUpdateMutatingWebhookConfiguration(caCert); err != nil {
+				m.fail("WebhookReconcileFailed", fmt.Errorf("failed to reconcile mutatingwebhookconfiguration/%s: %s", m.mutatingWebhookConfigurationName, err))
+				recheckAfter = time.Duration(10 * time.Second)
+				m.wait(recheckAfter)
+				continue
+			}
+		}
+		m.readiness.set(nil)
+		if !m.started {
+			select {
+			case m.isReadyCh <- true:
+			case <-m.ctx.Done():
+				return
+			}
+			m.started = true
+		}
+		m.wait(recheckAfter)
+	}
+}
@@ -4,7 +4,7 @@ cd "$dir"
 repo=${repo:-ghcr.io/galleybytes/terraform-operator-plugin-manager}
 tag=$(git describe --tags --dirty||true)
 tag=${tag:-0.0.0}
-CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -v -o bin/manager main.go
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -v -o bin/manager .
 docker build . -t "$repo:$tag"
 if [[ "$RELEASE_PROJECT" == true ]]; then
   docker push "$repo:$tag"
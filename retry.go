@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// retryBackoff is how API calls that fail transiently are retried before the failure is treated as
+// persistent
+var retryBackoff = wait.Backoff{
+	Steps:    6,
+	Duration: 500 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// retriable returns false for errors that retrying will not fix. Conflicts are retriable since the
+// retried function gets the latest version before updating.
+func retriable(err error) bool {
+	switch {
+	case errors.IsNotFound(err),
+		errors.IsForbidden(err),
+		errors.IsUnauthorized(err),
+		errors.IsInvalid(err),
+		errors.IsBadRequest(err),
+		errors.IsMethodNotSupported(err):
+		return false
+	}
+	return true
+}
+
+// readiness holds the last persistent failure of the manager
+type readiness struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (r *readiness) set(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+func (r *readiness) get() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
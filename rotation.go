@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/isaaguilar/selfsigned"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// A self-signed ca is rolled over in phases so the webhook's caBundle always trusts the serving cert.
+// The phase is tracked in the secret's annotations and the next ca is kept in the secret until the old
+// one is dropped.
+const (
+	caRolloverPhaseAnnotation      = "plugin-manager.galleybytes.com/ca-rollover-phase"
+	caRolloverSwitchedAtAnnotation = "plugin-manager.galleybytes.com/ca-rollover-switched-at"
+
+	// caRolloverPublished means ca.crt holds the old and the new ca and the serving cert is unchanged
+	caRolloverPublished = "published"
+	// caRolloverSwitched means the serving cert is issued by the new ca and both cas are still trusted
+	caRolloverSwitched = "switched"
+
+	nextCAKey  = "ca-next.key"
+	nextCACert = "ca-next.crt"
+)
+
+// clearCARollover removes the ca rollover state from the secret
+func clearCARollover(secret *corev1.Secret) {
+	delete(secret.Annotations, caRolloverPhaseAnnotation)
+	delete(secret.Annotations, caRolloverSwitchedAtAnnotation)
+	delete(secret.Data, nextCAKey)
+	delete(secret.Data, nextCACert)
+}
+
+// updateSecret applies the change to the latest version of the secret and updates it
+func (m Manager) updateSecret(change func(*corev1.Secret)) error {
+	secretClient := m.clientset.CoreV1().Secrets(m.namespace)
+	return retry.OnError(retryBackoff, retriable, func() error {
+		secret, err := secretClient.Get(m.ctx, m.secretName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		change(secret)
+		_, err = secretClient.Update(m.ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// advanceCARollover moves the ca rollover forward by at most one phase. It is only called once the
+// mounted certs match the secret and the webhook's caBundle was reconciled from them, so every phase is
+// trusted everywhere before the next one starts:
+//  1. published: the new ca is added to ca.crt next to the old one
+//  2. switched: the serving cert is issued by the new ca
+//  3. after the grace period the old ca is dropped from ca.crt
+//
+// The returned duration is when the rollover needs to be checked again, zero when none is in progress.
+func (m Manager) advanceCARollover(secret *corev1.Secret) (time.Duration, error) {
+	switch secret.Annotations[caRolloverPhaseAnnotation] {
+	case caRolloverPublished:
+		next := selfsigned.Signer{CAKey: secret.Data[nextCAKey], CACert: secret.Data[nextCACert]}
+		tlsCert, tlsKey, err := m.certs.newTLS(next, m.dnsNames)
+		if err != nil {
+			return 0, err
+		}
+		err = m.updateSecret(func(s *corev1.Secret) {
+			s.Data["ca.key"] = next.CAKey
+			s.Data["tls.crt"] = tlsCert
+			s.Data["tls.key"] = tlsKey
+			delete(s.Data, nextCAKey)
+			s.Annotations[caRolloverPhaseAnnotation] = caRolloverSwitched
+			s.Annotations[caRolloverSwitchedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		})
+		if err != nil {
+			return 0, err
+		}
+		logger.Info("CA rollover: serving cert is now issued by the new CA", "secret", m.secretName)
+		m.recorder.Event(m.deploymentRef(), corev1.EventTypeNormal, "CARolloverSwitched", "Serving cert is issued by the new CA")
+		return m.certs.caRolloverGracePeriod, nil
+
+	case caRolloverSwitched:
+		switchedAt, err := time.Parse(time.RFC3339, secret.Annotations[caRolloverSwitchedAtAnnotation])
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse '%s': %s", caRolloverSwitchedAtAnnotation, err)
+		}
+		if remaining := time.Until(switchedAt.Add(m.certs.caRolloverGracePeriod)); remaining > 0 {
+			return remaining, nil
+		}
+		newCACert := secret.Data[nextCACert]
+		err = m.updateSecret(func(s *corev1.Secret) {
+			s.Data["ca.crt"] = newCACert
+			clearCARollover(s)
+		})
+		if err != nil {
+			return 0, err
+		}
+		logger.Info("CA rollover: dropped the old CA", "secret", m.secretName)
+		m.recorder.Event(m.deploymentRef(), corev1.EventTypeNormal, "CARolloverCompleted", "Old CA is no longer trusted")
+		return 0, nil
+	}
+
+	caKey, err := parsePrivateKey(secret.Data["ca.key"])
+	if err != nil {
+		return 0, err
+	}
+	caCert, err := signingCert(secret.Data["ca.crt"], caKey)
+	if err != nil {
+		return 0, err
+	}
+	// The rollover needs two grace periods to finish before the ca enters the renewal window
+	if time.Now().Add(m.certs.renewBefore + 2*m.certs.caRolloverGracePeriod).Before(caCert.NotAfter) {
+		return 0, nil
+	}
+
+	next, err := m.certs.newCA()
+	if err != nil {
+		return 0, err
+	}
+	err = m.updateSecret(func(s *corev1.Secret) {
+		bundle := append([]byte{}, s.Data["ca.crt"]...)
+		if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+		s.Data["ca.crt"] = append(bundle, next.CACert...)
+		s.Data[nextCAKey] = next.CAKey
+		s.Data[nextCACert] = next.CACert
+		s.Annotations[caRolloverPhaseAnnotation] = caRolloverPublished
+	})
+	if err != nil {
+		return 0, err
+	}
+	logger.Info("CA rollover: published a new CA next to the old one", "secret", m.secretName)
+	m.recorder.Event(m.deploymentRef(), corev1.EventTypeNormal, "CARolloverStarted", "New CA is trusted next to the old one")
+	return time.Duration(10 * time.Second), nil
+}
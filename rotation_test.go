@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// testCertOptions are fast to generate certs with
+func testCertOptions() certOptions {
+	return certOptions{
+		validity:              24 * time.Hour,
+		caValidity:            10 * 24 * time.Hour,
+		renewBefore:           time.Hour,
+		recheckInterval:       time.Hour,
+		caRolloverGracePeriod: time.Hour,
+		keyAlgorithm:          keyAlgorithmECDSA,
+		keySize:               256,
+	}
+}
+
+var testDNSNames = genDNSNames("terraform-operator-plugin-manager", "tf-system")
+
+// testRolloverManager returns a manager with a secret holding certs whose ca expires after caValidity
+func testRolloverManager(t *testing.T, caValidity time.Duration) Manager {
+	t.Helper()
+	opts := testCertOptions()
+	opts.caValidity = caValidity
+	opts.validity = caValidity
+	selfSignedCert, err := opts.newSelfSignedCert(testDNSNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "certs", Namespace: "tf-system"},
+		Data: map[string][]byte{
+			"ca.key":  selfSignedCert.CAKey,
+			"ca.crt":  selfSignedCert.CACert,
+			"tls.key": selfSignedCert.TLSKey,
+			"tls.crt": selfSignedCert.TLSCert,
+		},
+	}
+	return Manager{
+		ctx:        context.Background(),
+		clientset:  fake.NewSimpleClientset(secret),
+		namespace:  "tf-system",
+		secretName: "certs",
+		certs:      testCertOptions(),
+		dnsNames:   testDNSNames,
+		recorder:   record.NewFakeRecorder(10),
+	}
+}
+
+func currentSecret(t *testing.T, m Manager) *corev1.Secret {
+	t.Helper()
+	secret, err := m.clientset.CoreV1().Secrets(m.namespace).Get(m.ctx, m.secretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestAdvanceCARolloverNotDue(t *testing.T) {
+	m := testRolloverManager(t, 10*24*time.Hour)
+	before := currentSecret(t, m)
+	next, err := m.advanceCARollover(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 0 {
+		t.Errorf("next check = %s, want none", next)
+	}
+	if after := currentSecret(t, m); after.Annotations[caRolloverPhaseAnnotation] != "" || !bytes.Equal(after.Data["ca.crt"], before.Data["ca.crt"]) {
+		t.Error("a rollover started for a ca that is not due")
+	}
+}
+
+func TestAdvanceCARollover(t *testing.T) {
+	// The ca expires within the renewal window plus two grace periods
+	m := testRolloverManager(t, 2*time.Hour)
+	original := currentSecret(t, m)
+
+	// 1. The new ca is published next to the old one and the serving cert is unchanged
+	if _, err := m.advanceCARollover(original); err != nil {
+		t.Fatal(err)
+	}
+	published := currentSecret(t, m)
+	if phase := published.Annotations[caRolloverPhaseAnnotation]; phase != caRolloverPublished {
+		t.Fatalf("phase = %s, want %s", phase, caRolloverPublished)
+	}
+	if !bytes.HasPrefix(published.Data["ca.crt"], original.Data["ca.crt"]) || !bytes.HasSuffix(published.Data["ca.crt"], published.Data[nextCACert]) {
+		t.Error("ca.crt does not hold the old and the new ca")
+	}
+	if !bytes.Equal(published.Data["tls.crt"], original.Data["tls.crt"]) {
+		t.Error("serving cert changed before the new ca was trusted")
+	}
+	if problem := validateCerts(published.Data["ca.key"], published.Data["ca.crt"], published.Data["tls.key"], published.Data["tls.crt"], testDNSNames, time.Now()); problem != nil {
+		t.Errorf("published certs are not valid: %s", problem)
+	}
+
+	// 2. The serving cert is issued by the new ca while both are trusted
+	next, err := m.advanceCARollover(published)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != m.certs.caRolloverGracePeriod {
+		t.Errorf("next check = %s, want the grace period %s", next, m.certs.caRolloverGracePeriod)
+	}
+	switched := currentSecret(t, m)
+	if phase := switched.Annotations[caRolloverPhaseAnnotation]; phase != caRolloverSwitched {
+		t.Fatalf("phase = %s, want %s", phase, caRolloverSwitched)
+	}
+	if problem := validateCerts(switched.Data["ca.key"], published.Data[nextCACert], switched.Data["tls.key"], switched.Data["tls.crt"], testDNSNames, time.Now()); problem != nil {
+		t.Errorf("serving cert is not issued by the new ca: %s", problem)
+	}
+	if problem := validateCerts(nil, switched.Data["ca.crt"], switched.Data["tls.key"], switched.Data["tls.crt"], testDNSNames, time.Now()); problem != nil {
+		t.Errorf("serving cert is not trusted by the ca bundle: %s", problem)
+	}
+
+	// 3. The old ca is kept for the grace period and then dropped
+	next, err = m.advanceCARollover(switched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= 0 || next > m.certs.caRolloverGracePeriod {
+		t.Errorf("next check = %s, want the rest of the grace period", next)
+	}
+	if currentSecret(t, m).Annotations[caRolloverPhaseAnnotation] != caRolloverSwitched {
+		t.Error("old ca was dropped before the grace period ended")
+	}
+	switched.Annotations[caRolloverSwitchedAtAnnotation] = time.Now().Add(-2 * m.certs.caRolloverGracePeriod).UTC().Format(time.RFC3339)
+	if next, err = m.advanceCARollover(switched); err != nil {
+		t.Fatal(err)
+	}
+	if next != 0 {
+		t.Errorf("next check = %s, want none", next)
+	}
+	completed := currentSecret(t, m)
+	if !bytes.Equal(completed.Data["ca.crt"], published.Data[nextCACert]) {
+		t.Error("ca.crt does not hold only the new ca")
+	}
+	if _, found := completed.Annotations[caRolloverPhaseAnnotation]; found {
+		t.Error("rollover phase was not cleared")
+	}
+	if _, found := completed.Data[nextCACert]; found {
+		t.Error("next ca was not cleared")
+	}
+	if problem := validateCerts(completed.Data["ca.key"], completed.Data["ca.crt"], completed.Data["tls.key"], completed.Data["tls.crt"], testDNSNames, time.Now()); problem != nil {
+		t.Errorf("certs after the rollover are not valid: %s", problem)
+	}
+}
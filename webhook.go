@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/galleybytes/terraform-operator-plugin-manager/internal/webserver"
+	addmissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// webhookOptions are the configurable parts of the mutating webhook registration
+type webhookOptions struct {
+	failurePolicy      addmissionregistrationv1.FailurePolicyType
+	matchPolicy        addmissionregistrationv1.MatchPolicyType
+	reinvocationPolicy addmissionregistrationv1.ReinvocationPolicyType
+	scope              addmissionregistrationv1.ScopeType
+	timeoutSeconds     int32
+	port               int32
+	path               string
+	namespaceSelector  *metav1.LabelSelector
+	objectSelector     *metav1.LabelSelector
+}
+
+// newWebhookOptions validates the webhook flags. Excluded namespaces are added to the namespace
+// selector by their `kubernetes.io/metadata.name` label.
+func newWebhookOptions() (webhookOptions, error) {
+	opts := webhookOptions{
+		failurePolicy:      addmissionregistrationv1.FailurePolicyType(webhookFailurePolicy),
+		matchPolicy:        addmissionregistrationv1.MatchPolicyType(webhookMatchPolicy),
+		reinvocationPolicy: addmissionregistrationv1.ReinvocationPolicyType(webhookReinvocationPolicy),
+		scope:              addmissionregistrationv1.ScopeType(webhookScope),
+		timeoutSeconds:     int32(webhookTimeoutSeconds),
+		port:               int32(webhookPort),
+		path:               webhookPath,
+	}
+
+	switch opts.failurePolicy {
+	case addmissionregistrationv1.Fail, addmissionregistrationv1.Ignore:
+	default:
+		return opts, fmt.Errorf("unknown webhook failure policy '%s'", opts.failurePolicy)
+	}
+	switch opts.matchPolicy {
+	case addmissionregistrationv1.Exact, addmissionregistrationv1.Equivalent:
+	default:
+		return opts, fmt.Errorf("unknown webhook match policy '%s'", opts.matchPolicy)
+	}
+	switch opts.reinvocationPolicy {
+	case addmissionregistrationv1.NeverReinvocationPolicy, addmissionregistrationv1.IfNeededReinvocationPolicy:
+	default:
+		return opts, fmt.Errorf("unknown webhook reinvocation policy '%s'", opts.reinvocationPolicy)
+	}
+	switch opts.scope {
+	case addmissionregistrationv1.AllScopes, addmissionregistrationv1.NamespacedScope, addmissionregistrationv1.ClusterScope:
+	default:
+		return opts, fmt.Errorf("unknown webhook scope '%s'", opts.scope)
+	}
+	if opts.timeoutSeconds < 1 || opts.timeoutSeconds > 30 {
+		return opts, fmt.Errorf("webhook timeout must be between 1 and 30 seconds")
+	}
+	if !strings.HasPrefix(opts.path, "/") {
+		return opts, fmt.Errorf("webhook path '%s' must start with '/'", opts.path)
+	}
+
+	var err error
+	opts.namespaceSelector, err = metav1.ParseToLabelSelector(webhookNamespaceSelector)
+	if err != nil {
+		return opts, fmt.Errorf("failed to parse webhook namespace selector: %s", err)
+	}
+	opts.objectSelector, err = metav1.ParseToLabelSelector(webhookObjectSelector)
+	if err != nil {
+		return opts, fmt.Errorf("failed to parse webhook object selector: %s", err)
+	}
+
+	excluded := splitList(webhookExcludeNamespaces)
+	if len(excluded) > 0 {
+		opts.namespaceSelector.MatchExpressions = append(opts.namespaceSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      "kubernetes.io/metadata.name",
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   excluded,
+		})
+	}
+	return opts, nil
+}
+
+// int32p returns an int32 pointer to the int32 value passed in
+func int32p(x int32) *int32 {
+	return &x
+}
+
+// stringp returns an string pointer to the string value passed in
+func stringp(s string) *string {
+	return &s
+}
+
+// mutatingWebhook returns the desired webhook
+func (m Manager) mutatingWebhook(caBundle []byte) addmissionregistrationv1.MutatingWebhook {
+	none := addmissionregistrationv1.SideEffectClassNone
+	return addmissionregistrationv1.MutatingWebhook{
+		Name: fmt.Sprintf("%s.galleybytes.com", m.mutatingWebhookConfigurationName),
+		ClientConfig: addmissionregistrationv1.WebhookClientConfig{
+			CABundle: caBundle,
+			Service: &addmissionregistrationv1.ServiceReference{
+				Namespace: m.namespace,
+				Name:      m.serviceName,
+				Port:      int32p(m.webhook.port),
+				Path:      stringp(m.webhook.path),
+			},
+		},
+		AdmissionReviewVersions: []string{"v1"},
+		TimeoutSeconds:          int32p(m.webhook.timeoutSeconds),
+		Rules: []addmissionregistrationv1.RuleWithOperations{
+			{
+				Operations: []addmissionregistrationv1.OperationType{addmissionregistrationv1.Create, addmissionregistrationv1.Update},
+				Rule: addmissionregistrationv1.Rule{
+					APIGroups:   []string{webserver.TerraformsGroup},
+					APIVersions: webserver.SupportedVersions(),
+					Resources:   []string{"terraforms"},
+					Scope:       &m.webhook.scope,
+				},
+			},
+		},
+		FailurePolicy:      &m.webhook.failurePolicy,
+		MatchPolicy:        &m.webhook.matchPolicy,
+		ReinvocationPolicy: &m.webhook.reinvocationPolicy,
+		NamespaceSelector:  m.webhook.namespaceSelector,
+		ObjectSelector:     m.webhook.objectSelector,
+		SideEffects:        &none,
+	}
+}
+
+// createOrUpdateMutatingWebhookConfiguration registers the webhook with the validated ca cert as its
+// caBundle
+func (m Manager) createOrUpdateMutatingWebhookConfiguration(caBundle []byte) error {
+	// The cert-manager CA injector fills in the caBundle when it is used
+	annotations := map[string]string{}
+	if m.injectsCA() {
+		annotations[injectCAAnnotation] = m.injectCAFrom()
+		caBundle = nil
+	}
+	webhooks := []addmissionregistrationv1.MutatingWebhook{m.mutatingWebhook(caBundle)}
+
+	mutatingWebhookConfigurationClient := m.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	// Conflicts are retried with the latest version of the webhook configuration
+	return retry.OnError(retryBackoff, retriable, func() error {
+		mutatingWebhookConfiguration, err := mutatingWebhookConfigurationClient.Get(m.ctx, m.mutatingWebhookConfigurationName, metav1.GetOptions{})
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return err
+			}
+
+			// Create it
+			mutatingWebhookConfiguration = &addmissionregistrationv1.MutatingWebhookConfiguration{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        m.mutatingWebhookConfigurationName,
+					Annotations: annotations,
+				},
+				Webhooks: webhooks,
+			}
+			_, err = mutatingWebhookConfigurationClient.Create(m.ctx, mutatingWebhookConfiguration, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			logger.Info("Created mutating webhook configuration", "name", m.mutatingWebhookConfigurationName)
+			m.recorder.Eventf(m.deploymentRef(), corev1.EventTypeNormal, "WebhookCreated", "Created mutatingwebhookconfiguration/%s", m.mutatingWebhookConfigurationName)
+			return nil
+		}
+
+		// The API server defaults unset fields so only compare the fields that are set
+		if equality.Semantic.DeepDerivative(webhooks, mutatingWebhookConfiguration.Webhooks) &&
+			equality.Semantic.DeepDerivative(annotations, mutatingWebhookConfiguration.Annotations) {
+			return nil
+		}
+		if m.injectsCA() {
+			// Keep the caBundle the injector set
+			for i := range webhooks {
+				if i < len(mutatingWebhookConfiguration.Webhooks) {
+					webhooks[i].ClientConfig.CABundle = mutatingWebhookConfiguration.Webhooks[i].ClientConfig.CABundle
+				}
+			}
+		}
+		if mutatingWebhookConfiguration.Annotations == nil {
+			mutatingWebhookConfiguration.Annotations = map[string]string{}
+		}
+		for key, value := range annotations {
+			mutatingWebhookConfiguration.Annotations[key] = value
+		}
+		mutatingWebhookConfiguration.Webhooks = webhooks
+		_, err = mutatingWebhookConfigurationClient.Update(m.ctx, mutatingWebhookConfiguration, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		logger.Info("Updated mutating webhook configuration", "name", m.mutatingWebhookConfigurationName)
+		m.recorder.Eventf(m.deploymentRef(), corev1.EventTypeNormal, "WebhookUpdated", "Updated mutatingwebhookconfiguration/%s", m.mutatingWebhookConfigurationName)
+		return nil
+	})
+}
+
+// splitList splits a comma separated flag and drops empty entries
+func splitList(s string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}